@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// AddrStatus is the serializable form of a CacheItemAddr, shared by the HTTP
+// API, the exports, and the cache file. In JSON, the address is split into its
+// network and string form, which parseAddr reverses.
+type AddrStatus struct {
+	Addr        net.Addr
+	Status      ConnectStatus
+	LastChecked time.Time // zero if the address has never been checked
+	Reason      string    // why the last check failed, empty otherwise
+}
+
+// addrStatusJSON is the JSON encoding of an AddrStatus.
+type addrStatusJSON struct {
+	Network     string        `json:"network"`
+	Addr        string        `json:"addr"`
+	Status      ConnectStatus `json:"status"`
+	LastChecked time.Time     `json:"lastChecked"`
+	Reason      string        `json:"reason,omitempty"`
+}
+
+func (s AddrStatus) MarshalJSON() ([]byte, error) {
+	if s.Addr == nil {
+		return nil, fmt.Errorf("AddrStatus without address")
+	}
+	return json.Marshal(addrStatusJSON{
+		Network:     s.Addr.Network(),
+		Addr:        s.Addr.String(),
+		Status:      s.Status,
+		LastChecked: s.LastChecked,
+		Reason:      s.Reason,
+	})
+}
+
+func (s *AddrStatus) UnmarshalJSON(b []byte) error {
+	var j addrStatusJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	addr, err := parseAddr(j.Network, j.Addr)
+	if err != nil {
+		return err
+	}
+	*s = AddrStatus{Addr: addr, Status: j.Status, LastChecked: j.LastChecked, Reason: j.Reason}
+	return nil
+}
+
+// AddrStatuses returns the addresses of the game, ordered by network and
+// address.
+func (g *CacheItem) AddrStatuses() []AddrStatus {
+	res := make([]AddrStatus, 0, len(g.Addrs))
+	for _, a := range g.Addrs {
+		res = append(res, AddrStatus{Addr: a.Addr, Status: a.Status, LastChecked: a.LastChecked, Reason: a.Reason})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if ni, nj := res[i].Addr.Network(), res[j].Addr.Network(); ni != nj {
+			return ni < nj
+		}
+		return res[i].Addr.String() < res[j].Addr.String()
+	})
+	return res
+}
+
+// parseAddr reverses net.Addr.String() for the address types in the cache.
+func parseAddr(network, addr string) (net.Addr, error) {
+	switch network {
+	case "tcp":
+		return net.ResolveTCPAddr(network, addr)
+	case "udp":
+		return net.ResolveUDPAddr(network, addr)
+	case "netpuncher4", "netpuncher6":
+		return ParseNetpuncherAddr(network, addr)
+	}
+	return nil, fmt.Errorf("unexpected network %s", network)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAddrStatusJSON(t *testing.T) {
+	checked := time.Date(2017, 3, 4, 19, 15, 0, 0, time.UTC)
+	for _, s := range []AddrStatus{
+		{Addr: &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}, Status: ConnectStatusSuccess, LastChecked: checked},
+		{Addr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11113}, Status: ConnectStatusPending},
+		{Addr: &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11114}, Status: ConnectStatusFailure, LastChecked: checked, Reason: "no ping reply"},
+		{Addr: &NetpuncherAddr{Net: "netpuncher4", Addr: "netpuncher.example:11115", ID: 12}, Status: ConnectStatusSuccess},
+		{Addr: &NetpuncherAddr{Net: "netpuncher6", Addr: "netpuncher.example:11115", ID: 1<<64 - 1}, Status: ConnectStatusFailure},
+	} {
+		b, err := json.Marshal(s)
+		if err != nil {
+			t.Errorf("%v: %v", s.Addr, err)
+			continue
+		}
+		var s2 AddrStatus
+		if err := json.Unmarshal(b, &s2); err != nil {
+			t.Errorf("%s: %v", b, err)
+			continue
+		}
+		if s2.Addr.Network() != s.Addr.Network() || s2.Addr.String() != s.Addr.String() {
+			t.Errorf("%s: got address %s %v", b, s2.Addr.Network(), s2.Addr)
+		}
+		s2.Addr = s.Addr
+		if !reflect.DeepEqual(s2, s) {
+			t.Errorf("%s: got %+v, want %+v", b, s2, s)
+		}
+	}
+
+	var s AddrStatus
+	for _, b := range []string{
+		`{"network": "ip", "addr": "1.2.3.4"}`,
+		`{"network": "netpuncher4", "addr": "netpuncher.example:11115"}`,
+		`{"network": "tcp", "addr": "1.2.3.4:99999"}`,
+	} {
+		if err := json.Unmarshal([]byte(b), &s); err == nil {
+			t.Errorf("%s: no error", b)
+		}
+	}
+	if _, err := json.Marshal(AddrStatus{}); err == nil {
+		t.Error("no error without address")
+	}
+}
+
+func TestCacheItemAddrStatuses(t *testing.T) {
+	tcp := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}
+	udp := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}
+	np := &NetpuncherAddr{Net: "netpuncher4", Addr: "invalid", ID: 1}
+	g := CacheItem{Addrs: map[string]CacheItemAddr{
+		cacheAddrKey(udp): {Addr: udp, Status: ConnectStatusFailure, Reason: "timeout"},
+		cacheAddrKey(tcp): {Addr: tcp, Status: ConnectStatusSuccess},
+		cacheAddrKey(np):  {Addr: np},
+	}}
+	want := []AddrStatus{
+		{Addr: np},
+		{Addr: tcp, Status: ConnectStatusSuccess},
+		{Addr: udp, Status: ConnectStatusFailure, Reason: "timeout"},
+	}
+	if got := g.AddrStatuses(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
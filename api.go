@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// wsPingInterval is the interval in which pings are sent to WebSocket clients,
+// so that idle connections aren't closed by proxies. It also limits the time
+// for sending a single message.
+var wsPingInterval = 30 * time.Second
+
+// apiGame is the JSON representation of a CacheItem.
+type apiGame struct {
+	Game          LeagueGame     `json:"game"`
+	Status        ConnectStatus  `json:"status"`
+	Joinable      bool           `json:"joinable"`
+	Addrs         []AddrStatus   `json:"addrs"`
+	AddrsFetched  bool           `json:"addrsFetched"`
+	NoPublicAddrs bool           `json:"noPublicAddrs"`
+	History       []StatusChange `json:"history"`
+}
+
+func newAPIGame(g CacheItem) apiGame {
+	js := g.JoinStatus()
+	ag := apiGame{Game: g.Game, Status: js.Reachability, Joinable: js.Joinable(), Addrs: g.AddrStatuses(), AddrsFetched: g.AddrsFetched, NoPublicAddrs: g.NoPublicAddrs, History: g.History}
+	if ag.History == nil {
+		ag.History = []StatusChange{}
+	}
+	return ag
+}
+
+// newAPIGames converts the games to a list ordered by source and id.
+func newAPIGames(games map[GameKey]CacheItem) []apiGame {
+	res := make([]apiGame, 0, len(games))
+	for _, g := range games {
+		res = append(res, newAPIGame(g))
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Game.Source != res[j].Game.Source {
+			return res[i].Game.Source < res[j].Game.Source
+		}
+		return res[i].Game.ID < res[j].Game.ID
+	})
+	return res
+}
+
+// apiDeletedGame is the payload of delete events. The source is only included
+// if set, matching LeagueGame.
+func apiDeletedGame(k GameKey) gin.H {
+	h := gin.H{"id": k.ID}
+	if k.Source != "" {
+		h["source"] = k.Source
+	}
+	return h
+}
+
+// apiGameOrders are the orders supported by gamesHandler. Games that compare
+// equal stay ordered by source and id.
+var apiGameOrders = map[string]func(a, b *apiGame) bool{
+	// oldest first
+	"created": func(a, b *apiGame) bool {
+		ta, _ := a.Game.CreatedTime()
+		tb, _ := b.Game.CreatedTime()
+		return ta.Before(tb)
+	},
+	"title": func(a, b *apiGame) bool {
+		return strings.ToLower(a.Game.Title) < strings.ToLower(b.Game.Title)
+	},
+	// most players first
+	"players": func(a, b *apiGame) bool {
+		return a.Game.PlayerCount() > b.Game.PlayerCount()
+	},
+}
+
+// gamesHandler serves the cached games as a JSON list, ordered by source and
+// id. The games can be filtered with the query parameters
+//
+//	engine: LeagueGame.Engine, e.g. OpenClonk
+//	status: LeagueGame.Status, e.g. lobby or running
+//
+// which are compared case-insensitively. Values that don't match any game
+// result in an empty list. The list can be sorted and paginated with
+//
+//	sort:   created, title or players, see apiGameOrders
+//	offset: number of games to skip
+//	limit:  maximum number of games to return
+func gamesHandler(cache *Cache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		less, ok := apiGameOrders[c.Query("sort")]
+		if !ok && c.Query("sort") != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid sort"})
+			return
+		}
+		offset, err := queryInt(c, "offset", 0)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid offset"})
+			return
+		}
+		limit, err := queryInt(c, "limit", -1)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+
+		engine, status := c.Query("engine"), c.Query("status")
+		games := newAPIGames(cache.GetFiltered(func(g CacheItem) bool {
+			return (engine == "" || strings.EqualFold(g.Game.Engine, engine)) &&
+				(status == "" || strings.EqualFold(g.Game.Status, status))
+		}))
+		if less != nil {
+			sort.SliceStable(games, func(i, j int) bool { return less(&games[i], &games[j]) })
+		}
+		if offset > len(games) {
+			offset = len(games)
+		}
+		games = games[offset:]
+		if limit >= 0 && limit < len(games) {
+			games = games[:limit]
+		}
+		c.JSON(http.StatusOK, games)
+	}
+}
+
+// queryInt returns the non-negative integer in the given query parameter, or
+// def if it isn't set.
+func queryInt(c *gin.Context, key string, def int) (int, error) {
+	v := c.Query(key)
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err == nil && i < 0 {
+		err = fmt.Errorf("negative %s", key)
+	}
+	return i, err
+}
+
+// queryDuration returns the non-negative duration in the given query
+// parameter, such as "500ms", or zero if it isn't set.
+func queryDuration(c *gin.Context, key string) (time.Duration, error) {
+	v := c.Query(key)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("negative %s", key)
+	}
+	return d, err
+}
+
+// subscribeGames subscribes to the cache like Cache.Subscribe. With a positive
+// debounce, individual updates are replaced by a single resync once there
+// were no changes for that long, for clients that re-render all games anyway.
+// The returned function unsubscribes.
+func subscribeGames(cache *Cache, debounce time.Duration) (map[GameKey]CacheItem, <-chan *CacheUpdate, func()) {
+	if debounce <= 0 {
+		games, updates := cache.Subscribe()
+		return games, updates, func() { cache.GameUpdates.Unregister(updates) }
+	}
+	d := cache.GameUpdates.RegisterDebounced(debounce)
+	updates := make(chan *CacheUpdate, 1)
+	go func() {
+		defer close(updates)
+		for range d.C {
+			select {
+			case updates <- cacheResync:
+			default:
+				// the previous resync is still pending
+			}
+		}
+	}()
+	// changes between registering and copying the state cause a
+	// redundant resync at worst
+	return cache.Get(), updates, d.Close
+}
+
+// gameEventsHandler streams changes to the cache as server-sent events. It
+// sends an init event with all games first, followed by update events with a
+// single game and delete events with the id of a removed game. A client that
+// falls behind gets another init event instead of the updates it missed.
+//
+// With the debounce query parameter, e.g. ?debounce=2s, the client instead
+// gets a new init event once the games haven't changed for that long.
+func gameEventsHandler(cache *Cache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		debounce, err := queryDuration(c, "debounce")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid debounce"})
+			return
+		}
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		games, updates, unsubscribe := subscribeGames(cache, debounce)
+		defer unsubscribe()
+
+		c.SSEvent("init", newAPIGames(games))
+		c.Writer.Flush()
+
+		for {
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case u, ok := <-updates:
+				if !ok {
+					// dropped as we were too slow, or the cache was closed
+					return
+				}
+				switch {
+				case u.Resync:
+					c.SSEvent("init", newAPIGames(cache.Get()))
+				case u.G != nil:
+					c.SSEvent("update", newAPIGame(*u.G))
+				default:
+					c.SSEvent("delete", apiDeletedGame(u.Key))
+				}
+				c.Writer.Flush()
+			}
+		}
+	}
+}
+
+// wsMessage is a message sent to WebSocket clients. Type and Data correspond
+// to the event types and data of gameEventsHandler.
+type wsMessage struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// wsPing sends a WebSocket ping. Clients answer with a pong, which is
+// discarded when reading.
+var wsPing = websocket.Codec{Marshal: func(interface{}) ([]byte, byte, error) {
+	return nil, websocket.PingFrame, nil
+}}
+
+// gameUpdatesWSHandler streams changes to the cache over a WebSocket, using
+// the same messages as gameEventsHandler. Every message is a JSON wsMessage.
+// Browsers may only connect from the same origin or from the given origins,
+// the CORS_ORIGINS of the HTTP API. The debounce query parameter works as for
+// gameEventsHandler.
+func gameUpdatesWSHandler(cache *Cache, origins []string) gin.HandlerFunc {
+	allowed := newOriginAllowlist(origins)
+	server := websocket.Server{
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			origin, err := websocket.Origin(config, r)
+			if err != nil {
+				return err
+			}
+			// clients other than browsers may not send an origin
+			if origin == nil || origin.Host == r.Host || allowed.allows(r.Header.Get("Origin")) {
+				config.Origin = origin
+				return nil
+			}
+			return fmt.Errorf("origin %s not allowed", origin)
+		},
+	}
+	return func(c *gin.Context) {
+		// reject invalid parameters before upgrading the connection
+		debounce, err := queryDuration(c, "debounce")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid debounce"})
+			return
+		}
+		s := server
+		s.Handler = func(ws *websocket.Conn) {
+			serveGameUpdatesWS(cache, ws, debounce)
+		}
+		s.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+func serveGameUpdatesWS(cache *Cache, ws *websocket.Conn, debounce time.Duration) {
+	games, updates, unsubscribe := subscribeGames(cache, debounce)
+	defer unsubscribe()
+
+	// Reading processes control frames and notices when the client
+	// disconnects. Clients aren't expected to send anything.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		io.Copy(ioutil.Discard, ws)
+	}()
+
+	send := func(codec websocket.Codec, v interface{}) error {
+		ws.SetWriteDeadline(time.Now().Add(wsPingInterval))
+		return codec.Send(ws, v)
+	}
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	err := send(websocket.JSON, wsMessage{"init", newAPIGames(games)})
+	for err == nil {
+		select {
+		case <-closed:
+			return
+		case <-ping.C:
+			err = send(wsPing, nil)
+		case u, ok := <-updates:
+			if !ok {
+				// dropped as we were too slow, or the cache was closed
+				return
+			}
+			switch {
+			case u.Resync:
+				err = send(websocket.JSON, wsMessage{"init", newAPIGames(cache.Get())})
+			case u.G != nil:
+				err = send(websocket.JSON, wsMessage{"update", newAPIGame(*u.G)})
+			default:
+				err = send(websocket.JSON, wsMessage{"delete", apiDeletedGame(u.Key)})
+			}
+		}
+	}
+}
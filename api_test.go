@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clonkspot/gocrema/eventsource"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+func TestGamesHandler(t *testing.T) {
+	c := NewCache()
+	defer c.Close()
+	c.UpdateAllGames([]LeagueGame{{ID: 2, Title: "bar"}, {ID: 1, Title: "foo"}})
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{&NetpuncherAddr{Net: "netpuncher4", Addr: "invalid", ID: 7}})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/games", gamesHandler(c))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/games", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+
+	var games []apiGame
+	if err := json.Unmarshal(w.Body.Bytes(), &games); err != nil {
+		t.Fatal(err)
+	}
+	if len(games) != 2 || games[0].Game.Title != "foo" || games[1].Game.Title != "bar" {
+		t.Fatalf("unexpected games %+v", games)
+	}
+	if addrs := games[0].Addrs; len(addrs) != 1 || addrs[0].Addr.Network() != "netpuncher4" || addrs[0].Addr.String() != "invalid#7" {
+		t.Errorf("unexpected addresses %+v", addrs)
+	}
+	if addrs := games[1].Addrs; addrs == nil || len(addrs) != 0 {
+		t.Errorf("unexpected addresses %+v", addrs)
+	}
+}
+
+func TestGamesHandlerFilter(t *testing.T) {
+	c := NewCache()
+	defer c.Close()
+	c.UpdateAllGames([]LeagueGame{
+		{ID: 1, Engine: "OpenClonk", Status: "lobby"},
+		{ID: 2, Engine: "OpenClonk", Status: "running"},
+		{ID: 3, Engine: "Clonk Rage", Status: "lobby"},
+	})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/games", gamesHandler(c))
+	tests := []struct {
+		query string
+		ids   []int
+	}{
+		{"", []int{1, 2, 3}},
+		{"?engine=OpenClonk", []int{1, 2}},
+		{"?engine=openclonk&status=Lobby", []int{1}},
+		{"?status=lobby", []int{1, 3}},
+		{"?engine=unknown", []int{}},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/games"+test.query, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status %d", test.query, w.Code)
+			continue
+		}
+		var games []apiGame
+		if err := json.Unmarshal(w.Body.Bytes(), &games); err != nil || games == nil {
+			t.Errorf("%s: invalid response %s", test.query, w.Body)
+			continue
+		}
+		ids := []int{}
+		for _, g := range games {
+			ids = append(ids, g.Game.ID)
+		}
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("%s: got games %v, want %v", test.query, ids, test.ids)
+		}
+	}
+}
+
+func TestGamesHandlerSort(t *testing.T) {
+	var games []LeagueGame
+	json.Unmarshal([]byte(`[
+		{"id": 1, "title": "b", "created": "2017-03-04T21:00:00+01:00", "players": [{}]},
+		{"id": 2, "title": "A", "created": "2017-03-04T20:00:00+01:00", "players": [{}, {}]},
+		{"id": 3, "title": "b", "created": "2017-03-04T20:00:00+01:00", "players": [{}, {}]},
+		{"id": 4, "title": "c"}
+	]`), &games)
+	c := NewCache()
+	defer c.Close()
+	c.UpdateAllGames(games)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/games", gamesHandler(c))
+	tests := []struct {
+		query string
+		ids   []int // nil for bad request
+	}{
+		{"", []int{1, 2, 3, 4}},
+		// ties stay ordered by id
+		{"?sort=title", []int{2, 1, 3, 4}},
+		{"?sort=created", []int{4, 2, 3, 1}},
+		{"?sort=players", []int{2, 3, 1, 4}},
+		{"?sort=title&offset=1&limit=2", []int{1, 3}},
+		{"?limit=0", []int{}},
+		{"?offset=10", []int{}},
+		{"?sort=bogus", nil},
+		{"?limit=-1", nil},
+		{"?offset=x", nil},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/games"+test.query, nil))
+		if test.ids == nil {
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s: status %d, want %d", test.query, w.Code, http.StatusBadRequest)
+			}
+			continue
+		}
+		var games []apiGame
+		if err := json.Unmarshal(w.Body.Bytes(), &games); w.Code != http.StatusOK || err != nil {
+			t.Errorf("%s: invalid response %d %s", test.query, w.Code, w.Body)
+			continue
+		}
+		ids := []int{}
+		for _, g := range games {
+			ids = append(ids, g.Game.ID)
+		}
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("%s: got games %v, want %v", test.query, ids, test.ids)
+		}
+	}
+}
+
+func TestGameEventsHandler(t *testing.T) {
+	c := NewCache()
+	defer c.Close()
+	c.UpdateGame(LeagueGame{ID: 1, Title: "foo"})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/games/events", gameEventsHandler(c))
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	es := eventsource.New(server.URL + "/games/events")
+	defer es.Close()
+	next := func() eventsource.Message {
+		for {
+			select {
+			case <-es.OnOpen:
+			case msg := <-es.OnMessage:
+				return msg
+			case err := <-es.OnError:
+				t.Fatal(err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for event")
+			}
+		}
+	}
+
+	msg := next()
+	var games []apiGame
+	if err := json.Unmarshal([]byte(msg.Data), &games); msg.EventType != "init" || err != nil || len(games) != 1 {
+		t.Fatalf("unexpected init event %+v (%v)", msg, err)
+	}
+	if c.GameUpdates.Count() != 1 {
+		t.Errorf("%d listeners, want 1", c.GameUpdates.Count())
+	}
+
+	c.UpdateGame(LeagueGame{ID: 2, Title: "bar"})
+	msg = next()
+	var game apiGame
+	if err := json.Unmarshal([]byte(msg.Data), &game); msg.EventType != "update" || err != nil || game.Game.Title != "bar" {
+		t.Errorf("unexpected update event %+v (%v)", msg, err)
+	}
+
+	c.DeleteGame(GameKey{ID: 1})
+	msg = next()
+	if msg.EventType != "delete" || msg.Data != `{"id":1}` {
+		t.Errorf("unexpected delete event %+v", msg)
+	}
+
+	// the listener is removed once the client disconnects
+	es.Close()
+	for i := 0; i < 100 && c.GameUpdates.Count() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if c.GameUpdates.Count() != 0 {
+		t.Errorf("%d listeners after disconnect", c.GameUpdates.Count())
+	}
+}
+
+func TestGameEventsHandlerDebounce(t *testing.T) {
+	c := NewCache()
+	defer c.Close()
+	c.UpdateGame(LeagueGame{ID: 1, Title: "foo"})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/games/events", gameEventsHandler(c))
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	for _, query := range []string{"?debounce=x", "?debounce=-1s"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/games/events"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	es := eventsource.New(server.URL + "/games/events?debounce=50ms")
+	defer es.Close()
+	next := func(timeout time.Duration) (eventsource.Message, bool) {
+		for {
+			select {
+			case <-es.OnOpen:
+			case msg := <-es.OnMessage:
+				return msg, true
+			case err := <-es.OnError:
+				t.Fatal(err)
+			case <-time.After(timeout):
+				return eventsource.Message{}, false
+			}
+		}
+	}
+	var games []apiGame
+	msg, ok := next(5 * time.Second)
+	if err := json.Unmarshal([]byte(msg.Data), &games); !ok || msg.EventType != "init" || err != nil || len(games) != 1 {
+		t.Fatalf("unexpected init event %+v (%v)", msg, err)
+	}
+
+	// a burst of changes results in a single init event
+	c.UpdateGame(LeagueGame{ID: 2, Title: "bar"})
+	c.UpdateGame(LeagueGame{ID: 3, Title: "baz"})
+	c.DeleteGame(GameKey{ID: 1})
+	msg, ok = next(5 * time.Second)
+	if err := json.Unmarshal([]byte(msg.Data), &games); !ok || msg.EventType != "init" || err != nil || len(games) != 2 {
+		t.Fatalf("unexpected event %+v (%v), want init with 2 games", msg, err)
+	}
+	if msg, ok := next(200 * time.Millisecond); ok {
+		t.Errorf("unexpected event %+v after debounced init", msg)
+	}
+
+	es.Close()
+	for i := 0; i < 100 && c.GameUpdates.Count() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if c.GameUpdates.Count() != 0 {
+		t.Errorf("%d listeners after disconnect", c.GameUpdates.Count())
+	}
+}
+
+func TestGameUpdatesWSHandler(t *testing.T) {
+	oldInterval := wsPingInterval
+	wsPingInterval = 10 * time.Millisecond
+	defer func() { wsPingInterval = oldInterval }()
+
+	c := NewCache()
+	defer c.Close()
+	c.UpdateGame(LeagueGame{ID: 1, Title: "foo"})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/ws", gameUpdatesWSHandler(c, nil))
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	next := func(data interface{}) string {
+		var msg struct {
+			Type string          `json:"type"`
+			Data json.RawMessage `json:"data"`
+		}
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(msg.Data, data); err != nil {
+			t.Errorf("invalid %s data %s: %v", msg.Type, msg.Data, err)
+		}
+		return msg.Type
+	}
+
+	var games []apiGame
+	if typ := next(&games); typ != "init" || len(games) != 1 {
+		t.Fatalf("unexpected init message %s %+v", typ, games)
+	}
+
+	// pings keep the connection open
+	time.Sleep(5 * wsPingInterval)
+	c.UpdateGame(LeagueGame{ID: 2, Title: "bar"})
+	var game apiGame
+	if typ := next(&game); typ != "update" || game.Game.Title != "bar" {
+		t.Errorf("unexpected update message %s %+v", typ, game)
+	}
+
+	c.DeleteGame(GameKey{ID: 1})
+	var del struct{ ID int }
+	if typ := next(&del); typ != "delete" || del.ID != 1 {
+		t.Errorf("unexpected delete message %s %+v", typ, del)
+	}
+
+	// the listener is removed once the client disconnects
+	ws.Close()
+	for i := 0; i < 100 && c.GameUpdates.Count() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if c.GameUpdates.Count() != 0 {
+		t.Errorf("%d listeners after disconnect", c.GameUpdates.Count())
+	}
+}
+
+func TestGameUpdatesWSHandlerDebounce(t *testing.T) {
+	c := NewCache()
+	defer c.Close()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/ws", gameUpdatesWSHandler(c, nil))
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	// invalid parameters are rejected before the upgrade
+	resp, err := http.Get(server.URL + "/ws?debounce=x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?debounce=50ms", "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	next := func() (string, []apiGame) {
+		var msg struct {
+			Type string    `json:"type"`
+			Data []apiGame `json:"data"`
+		}
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg.Type, msg.Data
+	}
+	if typ, games := next(); typ != "init" || len(games) != 0 {
+		t.Fatalf("unexpected message %s %+v", typ, games)
+	}
+	c.UpdateGame(LeagueGame{ID: 1, Title: "foo"})
+	c.UpdateGame(LeagueGame{ID: 2, Title: "bar"})
+	if typ, games := next(); typ != "init" || len(games) != 2 {
+		t.Errorf("unexpected message %s %+v, want init with 2 games", typ, games)
+	}
+}
+
+func TestGameUpdatesWSOrigin(t *testing.T) {
+	c := NewCache()
+	defer c.Close()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/ws", gameUpdatesWSHandler(c, []string{"https://allowed.example"}))
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	for origin, ok := range map[string]bool{
+		server.URL:                true,
+		"https://allowed.example": true,
+		"https://ALLOWED.example": true,
+		"https://evil.example":    false,
+	} {
+		ws, err := websocket.Dial(url, "", origin)
+		if ok != (err == nil) {
+			t.Errorf("origin %s: got error %v, want allowed %v", origin, err, ok)
+		}
+		if err == nil {
+			ws.Close()
+		}
+	}
+
+	// clients without an origin aren't browsers
+	req, _ := http.NewRequest("GET", server.URL+"/ws", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("got status %d without origin, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+}
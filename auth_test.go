@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTokenAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/open", tokenAuth(""), func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+	r.GET("/protected", tokenAuth("secret"), func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+
+	tests := []struct {
+		path, header string
+		code         int
+	}{
+		{"/open", "", http.StatusOK},
+		{"/protected", "", http.StatusUnauthorized},
+		{"/protected", "Bearer secret", http.StatusOK},
+		{"/protected", "Bearer wrong", http.StatusUnauthorized},
+		{"/protected", "Basic secret", http.StatusUnauthorized},
+		{"/protected?token=secret", "", http.StatusOK},
+		{"/protected?token=wrong", "", http.StatusUnauthorized},
+		// the header takes precedence
+		{"/protected?token=secret", "Bearer wrong", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.path, nil)
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != test.code {
+			t.Errorf("%s with %q: status %d, want %d", test.path, test.header, w.Code, test.code)
+		}
+	}
+}
+
+func TestAccessLogRedactsToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var buf bytes.Buffer
+	r := gin.New()
+	r.Use(gin.LoggerWithConfig(gin.LoggerConfig{Formatter: accessLogFormatter, Output: &buf}))
+	r.GET("/games/events", tokenAuth("secret"), func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+
+	for _, path := range []string{"/games/events?token=secret", "/games/events?limit=1&token=secret", "/games/events?token=%zz"} {
+		buf.Reset()
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		line := buf.String()
+		if !strings.Contains(line, "/games/events?") {
+			t.Errorf("%s: path missing from log line %q", path, line)
+		}
+		if strings.Contains(line, "secret") || strings.Contains(line, "%zz") {
+			t.Errorf("%s: token in log line %q", path, line)
+		}
+	}
+
+	tests := map[string]string{
+		"/games":                   "/games",
+		"/games?limit=1":           "/games?limit=1",
+		"/games?token=secret":      "/games?token=REDACTED",
+		"/games?token=a&token=b":   "/games?token=REDACTED",
+		"/games?limit=1&token=x":   "/games?limit=1&token=REDACTED",
+		"/games?token=%zz&limit=1": "/games?REDACTED",
+	}
+	for uri, want := range tests {
+		if got := redactToken(uri); got != want {
+			t.Errorf("redactToken(%q) = %q, want %q", uri, got, want)
+		}
+	}
+}
@@ -1,10 +1,69 @@
 package main
 
 import (
+	"container/list"
+	"context"
+	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apex/log"
 )
 
+// recheckInterval is the interval in which successfully checked addresses are
+// checked again.
+var recheckInterval = 60 * time.Second
+
+// recheckJitter randomizes the delay until the next check of an address by up
+// to this fraction in either direction, so that addresses added at the same
+// time, e.g. by an init event, don't keep being checked in bursts.
+var recheckJitter = 0.2
+
+// Failed addresses are retried with exponential backoff, starting at
+// failureBackoffMin and doubling up to failureBackoffMax.
+var (
+	failureBackoffMin = 10 * time.Second
+	failureBackoffMax = 5 * time.Minute
+)
+
+// pendingTimeout is the time after which a check that has not returned a
+// result is considered failed. Checks waiting for a worker don't time out.
+var pendingTimeout = 60 * time.Second
+
+// checkTimeoutReason is the failure reason for checks that exceeded
+// pendingTimeout.
+const checkTimeoutReason = "check timed out"
+
+// historyLength is the number of reachability changes kept per game in
+// CacheItem.History. Zero disables the history.
+var historyLength = 10
+
+// checkConcurrency is the maximum number of connection checks in flight.
+// Additional checks are queued.
+var checkConcurrency = 50
+
+// raceAddrs makes the scheduler check all addresses of a game together once
+// one of them is due, so that e.g. its IPv4 and IPv6 addresses race each other
+// instead of being checked at independent, jittered times. Results are still
+// recorded and reported per address as they arrive. Addresses in failure
+// backoff are checked along with the others.
+var raceAddrs = false
+
+// gameUpdatesBufSize is the number of updates buffered for each subscriber of
+// Cache.GameUpdates, such as SSE and WebSocket clients. A subscriber that
+// falls further behind misses updates and has to resync the full state.
+var gameUpdatesBufSize = notifierBufSize
+
+// scheduleInterval is the granularity of the check scheduler.
+var scheduleInterval = time.Second
+
 // ConnectStatus is the result of a connection check
 type ConnectStatus int
 
@@ -27,174 +86,741 @@ func (s ConnectStatus) String() string {
 	}
 }
 
+// MarshalJSON encodes the status as its String() form.
+func (s ConnectStatus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// UnmarshalJSON decodes a status from its String() form, or from the integer
+// used in older cache files.
+func (s *ConnectStatus) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		var i int
+		if json.Unmarshal(b, &i) != nil {
+			return fmt.Errorf("invalid connect status %s", b)
+		}
+		str = ConnectStatus(i).String()
+	}
+	cs, err := parseConnectStatus(str)
+	if err != nil {
+		return fmt.Errorf("invalid connect status %s", b)
+	}
+	*s = cs
+	return nil
+}
+
+// parseConnectStatus parses the String() form of a status.
+func parseConnectStatus(str string) (ConnectStatus, error) {
+	for _, cs := range []ConnectStatus{ConnectStatusPending, ConnectStatusSuccess, ConnectStatusFailure} {
+		if str == cs.String() {
+			return cs, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid connect status %q", str)
+}
+
 // Cache is responsible for storing connection tests.
 type Cache struct {
-	games             map[int]CacheItem
+	games             map[GameKey]CacheItem
 	updateRequestChan chan cacheReq
 	checkResultChan   chan cacheCheckMsg
-	requestGamesChan  chan chan map[int]CacheItem
-	GameUpdates       *Notifier // notifies about updated cache items (CacheUpdate)
+	checkRequestChan  chan cacheCheckMsg // consumed by the check workers
+	checkQueue        *list.List         // of cacheCheckMsg, waiting for a worker
+	queuedChecks      int64              // length of checkQueue, accessed atomically
+	activeChecks      int64              // checks run by the workers, accessed atomically
+	requestGamesChan  chan cacheGamesReq
+	requestGameChan   chan cacheGameReq
+	forEachChan       chan cacheForEachReq
+	statsChan         chan chan CacheStats
+	subscribeChan     chan chan cacheSubscription
+	GameUpdates       *Notifier[*CacheUpdate]          // notifies about updated cache items
+	ReachabilityFlips *Notifier[*ReachabilityFlip]     // notifies when a game's reachability changes, replaying the last flip to new listeners
+	Checker           Checker                          // checks addresses, defaultChecker unless replaced
+	Checks            CheckSink                        // receives all check results, discards them by default
+	inFlight          map[cacheCheckKey]*cacheInFlight // checks queued or run by a worker
+	lastCheckGen      uint64                           // generation of the last scheduled check
+	ctx               context.Context                  // parent of all checks, cancelled on shutdown
+	cancel            context.CancelFunc               // cancels ctx
+
+	done      chan struct{}  // closed by Close
+	closeOnce sync.Once      // guards closing done
+	stopped   chan struct{}  // closed once run has exited
+	workers   sync.WaitGroup // check workers
 }
 
 // NewCache creates a new cache.
 func NewCache() *Cache {
 	c := &Cache{
-		games:             make(map[int]CacheItem),
+		games:             make(map[GameKey]CacheItem),
 		updateRequestChan: make(chan cacheReq),
 		checkResultChan:   make(chan cacheCheckMsg),
-		requestGamesChan:  make(chan chan map[int]CacheItem),
-		GameUpdates:       NewNotifier(),
+		checkRequestChan:  make(chan cacheCheckMsg),
+		checkQueue:        list.New(),
+		requestGamesChan:  make(chan cacheGamesReq),
+		requestGameChan:   make(chan cacheGameReq),
+		forEachChan:       make(chan cacheForEachReq),
+		statsChan:         make(chan chan CacheStats),
+		subscribeChan:     make(chan chan cacheSubscription),
+		GameUpdates:       NewNotifierWithBuffer[*CacheUpdate](gameUpdatesBufSize),
+		ReachabilityFlips: NewReplayNotifier[*ReachabilityFlip](),
+		Checker:           defaultChecker,
+		Checks:            nopCheckSink{},
+		inFlight:          make(map[cacheCheckKey]*cacheInFlight),
+		done:              make(chan struct{}),
+		stopped:           make(chan struct{}),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	if cacheFile != "" {
+		if err := c.load(); err != nil && !os.IsNotExist(err) {
+			log.WithError(err).Error("loading cache failed")
+		}
+	}
+	c.workers.Add(checkConcurrency)
+	for i := 0; i < checkConcurrency; i++ {
+		go c.checkWorker()
 	}
 	go c.run()
 	return c
 }
 
+// Close stops the cache, cancelling in-flight checks, and closes
+// GameUpdates. Afterwards, updates are ignored and Get returns nil.
+func (c *Cache) Close() {
+	c.closeOnce.Do(func() { close(c.done) })
+	<-c.stopped
+}
+
+// request sends a request to the main loop, dropping it if the cache is closed.
+func (c *Cache) request(req cacheReq) {
+	select {
+	case c.updateRequestChan <- req:
+	case <-c.done:
+	}
+}
+
 // UpdateAllGames inserts and updates the given games, deleting all others from
-// the cache.
+// the cache. See SourceCache for updating the games of a single league.
 func (c *Cache) UpdateAllGames(games []LeagueGame) {
-	c.updateRequestChan <- cacheReq{
+	c.request(cacheReq{
 		reqType: reqUpdateAll,
 		payload: games,
-	}
+	})
+}
+
+// UpdateSourceGames inserts and updates the given games, deleting all other
+// games of the same source from the cache. Games of other sources are kept.
+func (c *Cache) UpdateSourceGames(source string, games []LeagueGame) {
+	c.request(cacheReq{
+		reqType: reqUpdateSource,
+		source:  source,
+		payload: games,
+	})
 }
 
 // UpdateGame inserts or updates a single game.
 func (c *Cache) UpdateGame(game LeagueGame) {
-	c.updateRequestChan <- cacheReq{
+	c.request(cacheReq{
 		reqType: reqUpdateSingle,
-		id:      game.ID,
+		id:      game.Key(),
 		payload: game,
-	}
+	})
 }
 
 // UpdateAddrs updates a game's addresses.
-func (c *Cache) UpdateAddrs(id int, addrs []net.Addr) {
-	c.updateRequestChan <- cacheReq{
+func (c *Cache) UpdateAddrs(id GameKey, addrs []net.Addr) {
+	c.request(cacheReq{
 		reqType: reqUpdateAddrs,
 		id:      id,
 		payload: addrs,
-	}
+	})
 }
 
 // DeleteGame removes a game from the cache.
-func (c *Cache) DeleteGame(id int) {
-	c.updateRequestChan <- cacheReq{
+func (c *Cache) DeleteGame(id GameKey) {
+	c.request(cacheReq{
 		reqType: reqDelete,
 		id:      id,
-	}
+	})
 }
 
 // Get retrieves a copy of the currently-cached games.
-func (c *Cache) Get() map[int]CacheItem {
-	res := make(chan map[int]CacheItem)
-	c.requestGamesChan <- res
-	return <-res
+func (c *Cache) Get() map[GameKey]CacheItem {
+	return c.GetFiltered(nil)
+}
+
+// GetFiltered retrieves a copy of the currently-cached games for which filter
+// returns true. The filter runs inside the cache main loop on the live data, so
+// it must neither modify the item nor block. A nil filter matches all games.
+func (c *Cache) GetFiltered(filter func(CacheItem) bool) map[GameKey]CacheItem {
+	req := cacheGamesReq{filter: filter, res: make(chan map[GameKey]CacheItem)}
+	select {
+	case c.requestGamesChan <- req:
+		return <-req.res
+	case <-c.done:
+		return nil
+	}
+}
+
+// GetReachable retrieves a copy of the games with at least one reachable
+// address.
+func (c *Cache) GetReachable() map[GameKey]CacheItem {
+	return c.GetFiltered(func(g CacheItem) bool {
+		return g.Reachability() == ConnectStatusSuccess
+	})
+}
+
+// ActiveChecks returns the number of connection checks in flight. At most
+// checkConcurrency checks run at the same time.
+func (c *Cache) ActiveChecks() int {
+	return int(atomic.LoadInt64(&c.activeChecks))
+}
+
+// QueuedChecks returns the number of connection checks waiting for a worker. A
+// queue that stays long means that checkConcurrency is too low for the number
+// of addresses or that checks are slow.
+func (c *Cache) QueuedChecks() int {
+	return int(atomic.LoadInt64(&c.queuedChecks))
+}
+
+// CountAddrsMissing returns the number of games whose addresses haven't been
+// fetched even though they were added longer than addrsFetchGrace ago, and the
+// total number of games.
+func (c *Cache) CountAddrsMissing(now time.Time) (missing, total int) {
+	c.ForEach(func(g CacheItem) bool {
+		total++
+		if !g.AddrsFetched && now.Sub(g.added) > addrsFetchGrace {
+			missing++
+		}
+		return true
+	})
+	return missing, total
+}
+
+// CacheStats are counts describing the cache contents.
+type CacheStats struct {
+	Games             int `json:"games"`
+	GamesWithoutAddrs int `json:"gamesWithoutAddrs"` // includes games whose addresses weren't fetched yet
+	Addrs             int `json:"addrs"`
+	AddrsPending      int `json:"addrsPending"`
+	AddrsSuccess      int `json:"addrsSuccess"`
+	AddrsFailure      int `json:"addrsFailure"`
+	ActiveChecks      int `json:"activeChecks"`
+	QueuedChecks      int `json:"queuedChecks"`
+}
+
+// Stats returns statistics about the cache, computed in a single pass in the
+// cache main loop. After Close, it returns zero counts.
+func (c *Cache) Stats() CacheStats {
+	res := make(chan CacheStats)
+	select {
+	case c.statsChan <- res:
+		return <-res
+	case <-c.done:
+		return CacheStats{}
+	}
+}
+
+// internal (run): stats computes the result of Stats.
+func (c *Cache) stats() CacheStats {
+	// the same count as QueuedChecks, which leaves out expired checks
+	// that nextQueuedCheck dropped
+	s := CacheStats{Games: len(c.games), ActiveChecks: c.ActiveChecks(), QueuedChecks: c.QueuedChecks()}
+	for _, g := range c.games {
+		if len(g.Addrs) == 0 {
+			s.GamesWithoutAddrs++
+		}
+		s.Addrs += len(g.Addrs)
+		for _, a := range g.Addrs {
+			switch a.Status {
+			case ConnectStatusPending:
+				s.AddrsPending++
+			case ConnectStatusSuccess:
+				s.AddrsSuccess++
+			case ConnectStatusFailure:
+				s.AddrsFailure++
+			}
+		}
+	}
+	return s
 }
 
-// internal (run): copyState copies the cache state.
-func (c *Cache) copyState() map[int]CacheItem {
-	games := make(map[int]CacheItem)
+// ForEach calls fn with a copy of every cached game, in no particular order,
+// until fn returns false. Unlike Get, it doesn't copy all games at once, so
+// it's suited for computing aggregates.
+//
+// fn runs inside the cache main loop, which is blocked until ForEach returns.
+// It must therefore not block or call any method of the cache, which would
+// deadlock. After Close, fn isn't called.
+func (c *Cache) ForEach(fn func(CacheItem) bool) {
+	req := cacheForEachReq{fn: fn, done: make(chan struct{})}
+	select {
+	case c.forEachChan <- req:
+		<-req.done
+	case <-c.done:
+	}
+}
+
+// Subscribe returns the current state of the cache along with a channel
+// registered on GameUpdates. The channel receives exactly the updates that
+// happen after the snapshot was taken, so applying them in order to the
+// snapshot gives the current state. If the consumer falls behind, e.g. during
+// an init with many games, updates are dropped and replaced by a single
+// update with Resync set, after which the consumer must replace its state
+// with a fresh copy from Get. Call GameUpdates.Unregister when done.
+//
+// After Close, Subscribe returns nil and a closed channel.
+func (c *Cache) Subscribe() (map[GameKey]CacheItem, <-chan *CacheUpdate) {
+	res := make(chan cacheSubscription)
+	select {
+	case c.subscribeChan <- res:
+		sub := <-res
+		return sub.games, sub.updates
+	case <-c.done:
+		return nil, c.GameUpdates.RegisterResync(cacheResync)
+	}
+}
+
+// GetGame retrieves a copy of a single cached game.
+func (c *Cache) GetGame(id GameKey) (CacheItem, bool) {
+	req := cacheGameReq{id: id, res: make(chan *CacheItem)}
+	select {
+	case c.requestGameChan <- req:
+		if g := <-req.res; g != nil {
+			return *g, true
+		}
+	case <-c.done:
+	}
+	return CacheItem{}, false
+}
+
+// internal (run): copyState copies the cache state, skipping games that don't
+// match the filter (if given).
+func (c *Cache) copyState(filter func(CacheItem) bool) map[GameKey]CacheItem {
+	games := make(map[GameKey]CacheItem)
 	for id, game := range c.games {
-		games[id] = game.Clone()
+		if filter == nil || filter(game) {
+			games[id] = game.Clone()
+		}
 	}
 	return games
 }
 
 // internal (run): notifyGameUpdate notifies listeners about an updated game.
-func (c *Cache) notifyGameUpdate(id int) {
+func (c *Cache) notifyGameUpdate(id GameKey) {
 	if g, ok := c.games[id]; ok {
 		g2 := g.Clone()
-		c.GameUpdates.Notify(&CacheUpdate{ID: id, G: &g2})
+		c.GameUpdates.Notify(&CacheUpdate{Key: id, G: &g2})
 	} else {
 		// game deleted
-		c.GameUpdates.Notify(&CacheUpdate{ID: id, G: nil})
+		c.GameUpdates.Notify(&CacheUpdate{Key: id, G: nil})
+	}
+}
+
+// internal (run): scheduleCheck queues a connection check for an address unless
+// there is already a check in flight.
+//
+// Every address is checked on its own, so the addresses of a game (e.g. IPv4
+// and IPv6) are checked in parallel and each result is reported as soon as it
+// arrives. A broken address family thus doesn't delay the others. With
+// raceAddrs, scheduleDueChecks also starts them at the same time.
+func (c *Cache) scheduleCheck(id GameKey, key string) {
+	a := c.games[id].Addrs[key]
+	if a.checking {
+		return
+	}
+	c.lastCheckGen++
+	a.checking = true
+	a.checkGen = c.lastCheckGen
+	a.checkStarted = time.Time{}
+	c.games[id].Addrs[key] = a
+	ctx, cancel := context.WithCancel(c.ctx)
+	e := c.checkQueue.PushBack(cacheCheckMsg{ctx: ctx, gen: a.checkGen, id: id, addr: a.Addr})
+	c.inFlight[cacheCheckKey{id, key}] = &cacheInFlight{cancel: cancel, queued: e}
+}
+
+// internal (run): cancelCheck cancels the check in flight for an address, if
+// any.
+func (c *Cache) cancelCheck(id GameKey, key string) {
+	k := cacheCheckKey{id, key}
+	if f, ok := c.inFlight[k]; ok {
+		f.cancel()
+		if f.queued != nil {
+			c.checkQueue.Remove(f.queued)
+		}
+		delete(c.inFlight, k)
+	}
+}
+
+// internal (run): deleteGame removes a game, cancelling its checks.
+func (c *Cache) deleteGame(id GameKey) {
+	for key := range c.games[id].Addrs {
+		c.cancelCheck(id, key)
+	}
+	delete(c.games, id)
+}
+
+// internal (run): nextQueuedCheck drops queued checks that are no longer
+// needed and returns the first remaining one.
+func (c *Cache) nextQueuedCheck() (cacheCheckMsg, bool) {
+	for e := c.checkQueue.Front(); e != nil; e = c.checkQueue.Front() {
+		req := e.Value.(cacheCheckMsg)
+		if game, ok := c.games[req.id]; ok {
+			if a, ok := game.Addrs[cacheAddrKey(req.addr)]; ok && a.isCheck(req.gen) {
+				return req, true
+			}
+		}
+		// game or address deleted, or check expired or replaced
+		c.checkQueue.Remove(e)
+	}
+	return cacheCheckMsg{}, false
+}
+
+// internal (run): scheduleDueChecks schedules a new check for all cached
+// addresses whose next check time has passed, or for all addresses of the game
+// with raceAddrs. Checks that have been running for longer than pendingTimeout
+// are marked as failed.
+func (c *Cache) scheduleDueChecks(now time.Time) {
+	for id, game := range c.games {
+		changed := false
+		due := false
+		var timedOut map[string]bool
+		for key, a := range game.Addrs {
+			if a.checking && !a.checkStarted.IsZero() && now.Sub(a.checkStarted) > pendingTimeout {
+				changed = changed || a.Status != ConnectStatusFailure || a.Reason != checkTimeoutReason
+				a.Status = ConnectStatusFailure
+				a.Reason = checkTimeoutReason
+				a.LastChecked = now
+				a.checking = false
+				a.scheduleNext(now)
+				game.Addrs[key] = a
+				c.cancelCheck(id, key)
+				if timedOut == nil {
+					timedOut = make(map[string]bool)
+				}
+				timedOut[key] = true
+			} else if !now.Before(a.nextCheck) {
+				c.scheduleCheck(id, key)
+				due = true
+			}
+		}
+		if raceAddrs && due {
+			for key := range game.Addrs {
+				// a check that just timed out is retried after its backoff
+				if !timedOut[key] {
+					c.scheduleCheck(id, key)
+				}
+			}
+		}
+		if changed {
+			c.updateReachability(id, now)
+			c.notifyGameUpdate(id)
+		}
+	}
+}
+
+// internal (run): updateReachability records the current reachability of the
+// game after a check if it changed, adding it to the history and notifying
+// ReachabilityFlips.
+func (c *Cache) updateReachability(id GameKey, now time.Time) {
+	g, ok := c.games[id]
+	if !ok {
+		return
+	}
+	s := g.Reachability()
+	if s == ConnectStatusPending || s == g.reachability {
+		return
+	}
+	flip := &ReachabilityFlip{Key: id, Time: now, From: g.reachability, To: s}
+	g.reachability = s
+	if historyLength > 0 {
+		if len(g.History) >= historyLength {
+			// copy instead of shifting in place, snapshots may share the array
+			g.History = append([]StatusChange(nil), g.History[len(g.History)-historyLength+1:]...)
+		}
+		g.History = append(g.History, StatusChange{Time: now, Status: s})
 	}
+	c.games[id] = g
+	c.ReachabilityFlips.Notify(flip)
+}
+
+// internal (run): shutdown stops the check workers and closes GameUpdates.
+func (c *Cache) shutdown() {
+	c.cancel()
+	close(c.checkRequestChan)
+	c.workers.Wait()
+	if cacheFile != "" {
+		if err := c.save(); err != nil {
+			log.WithError(err).Error("saving cache failed")
+		}
+	}
+	c.GameUpdates.Close()
+	c.ReachabilityFlips.Close()
+	close(c.stopped)
 }
 
 // run starts the cache main loop.
 func (c *Cache) run() {
-	updateGame := func(game *LeagueGame) {
-		g, ok := c.games[game.ID]
+	schedule := time.NewTicker(scheduleInterval)
+	defer schedule.Stop()
+	defer c.shutdown()
+
+	var persist <-chan time.Time
+	if cacheFile != "" {
+		t := time.NewTicker(persistInterval)
+		defer t.Stop()
+		persist = t.C
+	}
+
+	// updateGame returns whether the game was added or changed.
+	updateGame := func(game *LeagueGame) bool {
+		g, ok := c.games[game.Key()]
 		if !ok {
-			g = CacheItem{Addrs: make(map[string]CacheItemAddr)}
+			g = CacheItem{Addrs: make(map[string]CacheItemAddr), added: time.Now()}
+		} else if reflect.DeepEqual(g.Game, *game) {
+			return false
 		}
 		g.Game = *game
-		c.games[game.ID] = g
+		c.games[game.Key()] = g
+		return true
 	}
 	for {
+		// only offer a check to the workers if there is one queued
+		var checkRequestChan chan cacheCheckMsg
+		nextCheck, ok := c.nextQueuedCheck()
+		if ok {
+			checkRequestChan = c.checkRequestChan
+		}
+		atomic.StoreInt64(&c.queuedChecks, int64(c.checkQueue.Len()))
+
 		select {
+		case <-c.done:
+			return
+		case checkRequestChan <- nextCheck:
+			c.checkQueue.Remove(c.checkQueue.Front())
+			key := cacheAddrKey(nextCheck.addr)
+			if f := c.inFlight[cacheCheckKey{nextCheck.id, key}]; f != nil {
+				f.queued = nil
+			}
+			// pendingTimeout only applies once a worker runs the check
+			a := c.games[nextCheck.id].Addrs[key]
+			a.checkStarted = time.Now()
+			c.games[nextCheck.id].Addrs[key] = a
 		case req := <-c.updateRequestChan:
 			switch req.reqType {
-			case reqUpdateAll:
+			case reqUpdateAll, reqUpdateSource:
 				games := req.payload.([]LeagueGame)
-				seen := make(map[int]bool)
+				seen := make(map[GameKey]int)
 				for _, game := range games {
-					updateGame(&game)
-					seen[game.ID] = true
-					c.notifyGameUpdate(game.ID)
+					if updateGame(&game) {
+						c.notifyGameUpdate(game.Key())
+					}
+					seen[game.Key()]++
+				}
+				for id, n := range seen {
+					if n > 1 {
+						log.WithFields(log.Fields{"id": id.ID, "source": id.Source, "count": n}).Warn("cache: duplicate game id in update, keeping the last")
+					}
 				}
 				// delete games that weren't updated
-				for id := range c.games {
-					if !seen[id] {
-						delete(c.games, id)
+				for id, g := range c.games {
+					if seen[id] == 0 && (req.reqType == reqUpdateAll || g.Game.Source == req.source) {
+						c.deleteGame(id)
 						c.notifyGameUpdate(id)
 					}
 				}
 			case reqUpdateSingle:
 				game := req.payload.(LeagueGame)
-				updateGame(&game)
-				c.notifyGameUpdate(game.ID)
+				if updateGame(&game) {
+					c.notifyGameUpdate(game.Key())
+				}
 			case reqUpdateAddrs:
 				// drop request for unknown games
 				if game, ok := c.games[req.id]; ok {
 					addrs := req.payload.([]net.Addr)
+					changed := !game.AddrsFetched
+					game.AddrsFetched = true
+					seen := make(map[string]bool)
 					for _, addr := range addrs {
 						if !shouldSkipAddr(addr) {
-							if _, ok := game.Addrs[cacheAddrKey(addr)]; !ok {
+							key := cacheAddrKey(addr)
+							seen[key] = true
+							// duplicates share the key and are only
+							// checked once; the same endpoint on another
+							// transport is a different key
+							if _, ok := game.Addrs[key]; !ok {
 								// item is not in cache, check it now
-								game.Addrs[cacheAddrKey(addr)] = CacheItemAddr{Addr: addr, Status: ConnectStatusPending}
-								go c.check(cacheCheckMsg{id: req.id, addr: addr})
+								game.Addrs[key] = CacheItemAddr{Addr: addr, Status: ConnectStatusPending, backoff: failureBackoffMin}
+								c.scheduleCheck(req.id, key)
+								changed = true
 							}
 						}
 					}
+					// delete addresses the game no longer has; queued
+					// checks and results for them are dropped
+					for key := range game.Addrs {
+						if !seen[key] {
+							c.cancelCheck(req.id, key)
+							delete(game.Addrs, key)
+							changed = true
+						}
+					}
+					noPublic := len(addrs) > 0 && len(seen) == 0
+					if noPublic != game.NoPublicAddrs {
+						game.NoPublicAddrs = noPublic
+						changed = true
+						if noPublic {
+							log.WithFields(log.Fields{"id": req.id.ID, "source": req.id.Source, "addrs": len(addrs)}).Warn("cache: game has no public addresses")
+						}
+					}
+					c.games[req.id] = game
+					if changed {
+						// removing the only reachable address makes the
+						// game unreachable without any check finishing
+						c.updateReachability(req.id, time.Now())
+						c.notifyGameUpdate(req.id)
+					}
 				}
 			case reqDelete:
-				delete(c.games, req.id)
+				c.deleteGame(req.id)
 				c.notifyGameUpdate(req.id)
 			}
 		case res := <-c.checkResultChan:
+			// drop results for games or addresses deleted in the meantime
+			// and for checks that have expired or were cancelled
 			if game, ok := c.games[res.id]; ok {
 				key := cacheAddrKey(res.addr)
-				a := game.Addrs[key]
-				a.Status = res.status
-				game.Addrs[key] = a
-				c.notifyGameUpdate(res.id)
+				if a, ok := game.Addrs[key]; ok && a.isCheck(res.gen) {
+					c.cancelCheck(res.id, key)
+					now := time.Now()
+					reason := ""
+					if res.err != nil {
+						reason = res.err.Error()
+					}
+					changed := a.Status != res.status || a.Reason != reason
+					a.Status = res.status
+					a.Reason = reason
+					a.LastChecked = now
+					a.checking = false
+					a.scheduleNext(now)
+					game.Addrs[key] = a
+					// only notify about actual changes, not about
+					// re-checks confirming the previous status
+					if changed {
+						c.updateReachability(res.id, now)
+						c.notifyGameUpdate(res.id)
+					}
+				}
+			}
+		case now := <-schedule.C:
+			c.scheduleDueChecks(now)
+		case <-persist:
+			if err := c.save(); err != nil {
+				log.WithError(err).Error("saving cache failed")
+			}
+		case req := <-c.requestGamesChan:
+			req.res <- c.copyState(req.filter)
+		case res := <-c.subscribeChan:
+			// updates are only sent from this loop, so nothing can
+			// happen between the copy and the registration
+			res <- cacheSubscription{games: c.copyState(nil), updates: c.GameUpdates.RegisterResync(cacheResync)}
+		case res := <-c.statsChan:
+			res <- c.stats()
+		case req := <-c.forEachChan:
+			for _, g := range c.games {
+				if !req.fn(g.Clone()) {
+					break
+				}
+			}
+			close(req.done)
+		case req := <-c.requestGameChan:
+			if g, ok := c.games[req.id]; ok {
+				g2 := g.Clone()
+				req.res <- &g2
+			} else {
+				req.res <- nil
 			}
-		case resChan := <-c.requestGamesChan:
-			resChan <- c.copyState()
 		}
 	}
 }
 
 type cacheCheckMsg struct {
-	id     int           // game id
-	addr   net.Addr      // address to check
-	status ConnectStatus // reply: status
+	ctx    context.Context // cancelled if the check is no longer needed
+	gen    uint64          // generation of the check, see CacheItemAddr.checkGen
+	id     GameKey         // game
+	addr   net.Addr        // address to check
+	status ConnectStatus   // reply: status
+	err    error           // reply: reason for a failure
+}
+
+// checkWorker runs queued checks. Should be run from a goroutine.
+func (c *Cache) checkWorker() {
+	defer c.workers.Done()
+	for req := range c.checkRequestChan {
+		c.check(req)
+	}
 }
 
-// check tries to connect to the given address. Should be run from a goroutine.
+// check tries to connect to the given address.
 func (c *Cache) check(req cacheCheckMsg) {
-	req.status = ConnectStatusFailure
-	if tryConnect(req.addr) {
-		req.status = ConnectStatusSuccess
+	atomic.AddInt64(&c.activeChecks, 1)
+	var latency time.Duration
+	req.status, latency, req.err = c.Checker(req.ctx, req.addr)
+	now := time.Now()
+	atomic.AddInt64(&c.activeChecks, -1)
+	c.Checks.Record(CheckResult{
+		Key:     req.id,
+		Addr:    req.addr,
+		Status:  req.status,
+		Err:     req.err,
+		Time:    now,
+		Latency: latency,
+		Punch:   punchOutcome(req.addr, req.err),
+	})
+	select {
+	case c.checkResultChan <- req:
+	case <-c.done:
+		// the cache is shutting down, drop the result
 	}
-	c.checkResultChan <- req
+}
+
+// cacheInFlight is a check that is queued or run by a worker.
+type cacheInFlight struct {
+	cancel context.CancelFunc // cancels the check
+	queued *list.Element      // in checkQueue, nil once a worker took the check
+}
+
+// cacheCheckKey identifies the address of a game.
+type cacheCheckKey struct {
+	id  GameKey
+	key string // cacheAddrKey
+}
+
+type cacheGamesReq struct {
+	filter func(CacheItem) bool // optional
+	res    chan map[GameKey]CacheItem
+}
+
+type cacheSubscription struct {
+	games   map[GameKey]CacheItem
+	updates <-chan *CacheUpdate
+}
+
+type cacheGameReq struct {
+	id  GameKey
+	res chan *CacheItem // reply: game or nil if not found
+}
+
+type cacheForEachReq struct {
+	fn   func(CacheItem) bool
+	done chan struct{} // closed once fn returned false or saw all games
 }
 
 type cacheReqType int
 
 const (
 	reqUpdateAll cacheReqType = iota
+	reqUpdateSource
 	reqUpdateSingle
 	reqUpdateAddrs
 	reqDelete
@@ -202,14 +828,36 @@ const (
 
 type cacheReq struct {
 	reqType cacheReqType
-	id      int
+	id      GameKey
+	source  string // for reqUpdateSource
 	payload interface{}
 }
 
 // CacheItem is a game with associated addresses.
 type CacheItem struct {
-	Game  LeagueGame               // includes ID
-	Addrs map[string]CacheItemAddr // indexed by cacheAddrKey
+	Game    LeagueGame               // includes ID
+	Addrs   map[string]CacheItemAddr // indexed by cacheAddrKey
+	History []StatusChange           // last historyLength changes of Reachability, oldest first
+
+	// AddrsFetched is set once the addresses were fetched from the league,
+	// even if there were none. Without it, the game's addresses are unknown
+	// rather than unreachable.
+	AddrsFetched bool
+	// NoPublicAddrs is set if the league announced addresses for the game,
+	// but all of them were skipped as not reachable from the internet,
+	// e.g. private or link-local ones.
+	NoPublicAddrs bool
+
+	reachability ConnectStatus // last recorded Reachability, pending if none yet
+	added        time.Time     // time the game was added to the cache
+}
+
+// StatusChange records that the reachability of a game changed. The first
+// entry is the reachability after the first completed check; changes to and
+// from pending are not recorded.
+type StatusChange struct {
+	Time   time.Time     `json:"time"`
+	Status ConnectStatus `json:"status"`
 }
 
 // Clone creates a deep copy of the cache item.
@@ -217,23 +865,195 @@ func (g *CacheItem) Clone() CacheItem {
 	g2 := *g
 	g2.Addrs = make(map[string]CacheItemAddr)
 	for key, addr := range g.Addrs {
+		// Addr is never modified, so copying the struct (including
+		// LastChecked) is sufficient.
 		g2.Addrs[key] = addr
 	}
+	g2.History = append([]StatusChange(nil), g.History...)
 	return g2
 }
 
+// Reachability returns the aggregate status of the game's addresses: success
+// if any address is reachable, pending if any address hasn't been checked yet,
+// and failure otherwise (including games without addresses).
+func (g *CacheItem) Reachability() ConnectStatus {
+	s := ConnectStatusFailure
+	for _, addr := range g.Addrs {
+		s = combineStatus(s, addr.Status)
+	}
+	return s
+}
+
+// FamilyReachability is like Reachability, but only considers addresses of the
+// given IP family (4 or 6).
+func (g *CacheItem) FamilyReachability(family int) ConnectStatus {
+	s := ConnectStatusFailure
+	for _, addr := range g.Addrs {
+		if addrFamily(addr.Addr) == family {
+			s = combineStatus(s, addr.Status)
+		}
+	}
+	return s
+}
+
+// IPv4Reachability returns the aggregate status of the game's IPv4 addresses.
+func (g *CacheItem) IPv4Reachability() ConnectStatus {
+	return g.FamilyReachability(4)
+}
+
+// IPv6Reachability returns the aggregate status of the game's IPv6 addresses.
+func (g *CacheItem) IPv6Reachability() ConnectStatus {
+	return g.FamilyReachability(6)
+}
+
+// TransportReachability returns the aggregate status of the game's addresses
+// per transport ("tcp", "udp", or "netpuncher"). Transports without addresses
+// are missing from the result.
+func (g *CacheItem) TransportReachability() map[string]ConnectStatus {
+	res := make(map[string]ConnectStatus)
+	for _, addr := range g.Addrs {
+		t := addrTransport(addr.Addr)
+		if s, ok := res[t]; ok {
+			res[t] = combineStatus(s, addr.Status)
+		} else {
+			res[t] = addr.Status
+		}
+	}
+	return res
+}
+
+// JoinStatus describes whether a user can join a game: it has to be
+// reachable and open for joining, and may require a password.
+type JoinStatus struct {
+	Reachability   ConnectStatus
+	JoinAllowed    bool
+	PasswordNeeded bool
+}
+
+// Joinable returns whether the game is reachable and allows joining. A
+// password may still be needed.
+func (s JoinStatus) Joinable() bool {
+	return s.Reachability == ConnectStatusSuccess && s.JoinAllowed
+}
+
+// JoinStatus returns the reachability of the game along with its join flags.
+func (g *CacheItem) JoinStatus() JoinStatus {
+	return JoinStatus{
+		Reachability:   g.Reachability(),
+		JoinAllowed:    g.Game.Flags.JoinAllowed,
+		PasswordNeeded: g.Game.Flags.PasswordNeeded,
+	}
+}
+
+// combineStatus merges two statuses, preferring success over pending over
+// failure.
+func combineStatus(a, b ConnectStatus) ConnectStatus {
+	switch {
+	case a == ConnectStatusSuccess || b == ConnectStatusSuccess:
+		return ConnectStatusSuccess
+	case a == ConnectStatusPending || b == ConnectStatusPending:
+		return ConnectStatusPending
+	default:
+		return ConnectStatusFailure
+	}
+}
+
+// addrTransport returns the transport of an address, i.e. its network without
+// the IP family.
+func addrTransport(a net.Addr) string {
+	return strings.TrimRight(a.Network(), "46")
+}
+
+// addrFamily returns the IP family (4 or 6) of an address, or 0 if unknown.
+func addrFamily(a net.Addr) int {
+	var ip net.IP
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case *NetpuncherAddr:
+		// the family is part of the network name (netpuncher4/netpuncher6)
+		switch {
+		case strings.HasSuffix(a.Net, "4"):
+			return 4
+		case strings.HasSuffix(a.Net, "6"):
+			return 6
+		}
+		return 0
+	}
+	switch {
+	case ip.To4() != nil:
+		return 4
+	case ip.To16() != nil:
+		return 6
+	}
+	return 0
+}
+
 func cacheAddrKey(a net.Addr) string {
 	return fmt.Sprintf("%s:%s", a.Network(), a.String())
 }
 
 // CacheItemAddr is a single address that has been checked.
 type CacheItemAddr struct {
-	Addr   net.Addr
-	Status ConnectStatus
+	Addr        net.Addr
+	Status      ConnectStatus
+	LastChecked time.Time // zero if the address has never been checked
+	Reason      string    // why the last check failed, empty otherwise
+
+	checking     bool          // a check is in flight
+	checkGen     uint64        // generation of the check in flight, tells it apart from cancelled ones
+	checkStarted time.Time     // time a worker started the check in flight, zero while queued
+	nextCheck    time.Time     // time of the next scheduled check
+	backoff      time.Duration // retry delay after the next failure
+}
+
+// isCheck returns whether the check with the given generation is the one in
+// flight for the address.
+func (a *CacheItemAddr) isCheck(gen uint64) bool {
+	return a.checking && a.checkGen == gen
+}
+
+// scheduleNext sets the next check time after a finished check.
+func (a *CacheItemAddr) scheduleNext(now time.Time) {
+	if a.Status != ConnectStatusFailure {
+		a.backoff = failureBackoffMin
+		a.nextCheck = now.Add(jitter(recheckInterval))
+		return
+	}
+	a.nextCheck = now.Add(jitter(a.backoff))
+	a.backoff *= 2
+	if a.backoff > failureBackoffMax {
+		a.backoff = failureBackoffMax
+	}
+}
+
+// jitter randomizes d by up to recheckJitter in either direction.
+func jitter(d time.Duration) time.Duration {
+	if recheckJitter <= 0 {
+		return d
+	}
+	return d + time.Duration((rand.Float64()*2-1)*recheckJitter*float64(d))
 }
 
 // CacheUpdate is the broadcasted via Cache.GameUpdates
 type CacheUpdate struct {
-	ID int
-	G  *CacheItem // might be nil for deleted games
+	Key GameKey
+	G   *CacheItem // might be nil for deleted games
+
+	// Resync is set on the update replacing dropped updates, see
+	// Cache.Subscribe. Key and G are unset.
+	Resync bool
+}
+
+// cacheResync is the sentinel sent to subscribers that fell behind.
+var cacheResync = &CacheUpdate{Resync: true}
+
+// ReachabilityFlip is sent when a game becomes reachable or unreachable. The
+// first flip of a game after its first completed check is from pending.
+type ReachabilityFlip struct {
+	Key      GameKey
+	Time     time.Time
+	From, To ConnectStatus // To is never pending
 }
@@ -0,0 +1,1161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+)
+
+func TestCacheClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	c := NewCache()
+	updates := c.GameUpdates.Register()
+	c.UpdateGame(LeagueGame{ID: 1})
+	// fails quickly as the address cannot be resolved
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{&NetpuncherAddr{Net: "netpuncher4", Addr: "invalid", ID: 1}})
+	c.Get()
+	c.Close()
+
+	// GameUpdates must be closed
+	for range updates {
+	}
+
+	// calls after Close must not block
+	c.UpdateGame(LeagueGame{ID: 2})
+	c.DeleteGame(GameKey{ID: 1})
+	if games := c.Get(); games != nil {
+		t.Errorf("Get after Close returned %v", games)
+	}
+	c.Close()
+
+	// exiting goroutines may take a moment to disappear
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines leaked", n-before)
+	}
+}
+
+func TestCacheGetGame(t *testing.T) {
+	c := NewCache()
+	defer c.Close()
+
+	c.UpdateGame(LeagueGame{ID: 1, Title: "foo"})
+	if g, ok := c.GetGame(GameKey{ID: 1}); !ok || g.Game.Title != "foo" {
+		t.Errorf("GetGame(1) = %+v, %v", g, ok)
+	}
+	if _, ok := c.GetGame(GameKey{ID: 2}); ok {
+		t.Error("GetGame(2) found a game that doesn't exist")
+	}
+}
+
+func TestCacheGetFiltered(t *testing.T) {
+	c := NewCache()
+	defer c.Close()
+	reachable := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}
+	unreachable := &net.TCPAddr{IP: net.ParseIP("1.2.3.5"), Port: 11113}
+	c.Checker = connectChecker(func(ctx context.Context, addr net.Addr) error {
+		if addr.String() == unreachable.String() {
+			return errors.New("unreachable")
+		}
+		return nil
+	})
+	c.UpdateAllGames([]LeagueGame{
+		{ID: 1, Status: "lobby"},
+		{ID: 2, Status: "lobby"},
+		{ID: 3, Status: "running"},
+		{ID: 4, Status: "lobby"},
+	})
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{reachable})
+	c.UpdateAddrs(GameKey{ID: 2}, []net.Addr{unreachable})
+	c.UpdateAddrs(GameKey{ID: 3}, []net.Addr{reachable})
+	// game 4 has no addresses and stays pending
+	for i := 0; hasPendingAddrs(c.Get()); i++ {
+		if i == 5000 {
+			t.Fatal("addresses not checked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ids := func(games map[GameKey]CacheItem) map[int]bool {
+		res := make(map[int]bool)
+		for k := range games {
+			res[k.ID] = true
+		}
+		return res
+	}
+	lobby := c.GetFiltered(func(g CacheItem) bool { return g.Game.Status == "lobby" })
+	if got, want := ids(lobby), map[int]bool{1: true, 2: true, 4: true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetFiltered: got games %v, want %v", got, want)
+	}
+	if got := c.GetFiltered(func(g CacheItem) bool { return false }); len(got) != 0 {
+		t.Errorf("GetFiltered: got %d games for a filter matching none", len(got))
+	}
+	if got := c.GetFiltered(nil); len(got) != 4 {
+		t.Errorf("GetFiltered: got %d games without filter, want 4", len(got))
+	}
+	if got, want := ids(c.GetReachable()), map[int]bool{1: true, 3: true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetReachable: got games %v, want %v", got, want)
+	}
+}
+
+func TestCacheItemReachability(t *testing.T) {
+	tcp := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}
+	udp := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11114}
+	np := &NetpuncherAddr{Net: "netpuncher6", Addr: "netpuncher.example:11115", ID: 1}
+	item := func(addrs ...CacheItemAddr) CacheItem {
+		g := CacheItem{Addrs: make(map[string]CacheItemAddr)}
+		for _, a := range addrs {
+			g.Addrs[cacheAddrKey(a.Addr)] = a
+		}
+		return g
+	}
+
+	tests := []struct {
+		name string
+		g    CacheItem
+		want ConnectStatus
+	}{
+		{"empty", item(), ConnectStatusFailure},
+		{"all pending", item(
+			CacheItemAddr{Addr: tcp, Status: ConnectStatusPending},
+			CacheItemAddr{Addr: udp, Status: ConnectStatusPending},
+		), ConnectStatusPending},
+		{"pending and failure", item(
+			CacheItemAddr{Addr: tcp, Status: ConnectStatusFailure},
+			CacheItemAddr{Addr: udp, Status: ConnectStatusPending},
+		), ConnectStatusPending},
+		{"all failed", item(
+			CacheItemAddr{Addr: tcp, Status: ConnectStatusFailure},
+			CacheItemAddr{Addr: udp, Status: ConnectStatusFailure},
+		), ConnectStatusFailure},
+		{"one success", item(
+			CacheItemAddr{Addr: tcp, Status: ConnectStatusFailure},
+			CacheItemAddr{Addr: udp, Status: ConnectStatusPending},
+			CacheItemAddr{Addr: np, Status: ConnectStatusSuccess},
+		), ConnectStatusSuccess},
+	}
+	for _, test := range tests {
+		if s := test.g.Reachability(); s != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, s, test.want)
+		}
+	}
+
+	g := tests[len(tests)-1].g
+	tr := g.TransportReachability()
+	want := map[string]ConnectStatus{
+		"tcp":        ConnectStatusFailure,
+		"udp":        ConnectStatusPending,
+		"netpuncher": ConnectStatusSuccess,
+	}
+	if len(tr) != len(want) {
+		t.Errorf("TransportReachability: got %v, want %v", tr, want)
+	}
+	for k, s := range want {
+		if tr[k] != s {
+			t.Errorf("TransportReachability[%s]: got %v, want %v", k, tr[k], s)
+		}
+	}
+}
+
+func TestCacheItemFamilyReachability(t *testing.T) {
+	g := CacheItem{Addrs: make(map[string]CacheItemAddr)}
+	for _, a := range []CacheItemAddr{
+		{Addr: &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}, Status: ConnectStatusFailure},
+		{Addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11114}, Status: ConnectStatusSuccess},
+		{Addr: &NetpuncherAddr{Net: "netpuncher4", Addr: "netpuncher.example:11115", ID: 1}, Status: ConnectStatusPending},
+	} {
+		g.Addrs[cacheAddrKey(a.Addr)] = a
+	}
+	if s := g.IPv4Reachability(); s != ConnectStatusPending {
+		t.Errorf("IPv4Reachability: got %v, want %v", s, ConnectStatusPending)
+	}
+	if s := g.IPv6Reachability(); s != ConnectStatusSuccess {
+		t.Errorf("IPv6Reachability: got %v, want %v", s, ConnectStatusSuccess)
+	}
+}
+
+func TestCacheNotifiesOnlyChanges(t *testing.T) {
+	c := NewCache()
+	defer c.Close()
+	updates := c.GameUpdates.Register()
+
+	c.UpdateGame(LeagueGame{ID: 1, Title: "foo"})
+	c.UpdateGame(LeagueGame{ID: 1, Title: "foo"})
+	c.UpdateAllGames([]LeagueGame{{ID: 1, Title: "foo"}})
+	c.UpdateGame(LeagueGame{ID: 1, Title: "bar"})
+	c.Get()
+
+	for _, title := range []string{"foo", "bar"} {
+		select {
+		case u := <-updates:
+			if g := u.G; g == nil || g.Game.Title != title {
+				t.Errorf("unexpected update %+v, want title %q", g, title)
+			}
+		default:
+			t.Fatalf("missing update for title %q", title)
+		}
+	}
+	select {
+	case u := <-updates:
+		t.Errorf("unexpected update %+v", u.G)
+	default:
+	}
+}
+
+func TestCacheChecksAddressesInParallel(t *testing.T) {
+	c := NewCache()
+	defer c.Close()
+	updates := c.GameUpdates.RegisterBlocking()
+	tcp4 := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}
+	tcp6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11113}
+	// the IPv4 check hangs until the end of the test
+	release := make(chan struct{})
+	defer close(release)
+	c.Checker = connectChecker(func(ctx context.Context, addr net.Addr) error {
+		if addr.String() == tcp4.String() {
+			<-release
+		}
+		return nil
+	})
+
+	c.UpdateGame(LeagueGame{ID: 1})
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{tcp4, tcp6})
+	<-updates // game added
+	<-updates // addresses added
+
+	select {
+	case u := <-updates:
+		if s := u.G.IPv6Reachability(); s != ConnectStatusSuccess {
+			t.Errorf("IPv6: got %v, want %v", s, ConnectStatusSuccess)
+		}
+		if s := u.G.IPv4Reachability(); s != ConnectStatusPending {
+			t.Errorf("IPv4: got %v, want %v", s, ConnectStatusPending)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("IPv6 result was not reported while the IPv4 check was running")
+	}
+}
+
+func TestCacheRaceAddrs(t *testing.T) {
+	defer fastRechecks()()
+	oldRace, oldBackoff := raceAddrs, failureBackoffMin
+	failureBackoffMin = time.Hour
+	defer func() { raceAddrs, failureBackoffMin = oldRace, oldBackoff }()
+
+	tcp4 := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}
+	tcp6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11113}
+	// the IPv4 address is broken and would only be retried after an hour
+	run := func(race bool) (v4, v6 int32, g CacheItem) {
+		raceAddrs = race
+		c := NewCache()
+		defer c.Close()
+		c.Checker = connectChecker(func(ctx context.Context, addr net.Addr) error {
+			if addr.String() == tcp4.String() {
+				atomic.AddInt32(&v4, 1)
+				return errors.New("unreachable")
+			}
+			atomic.AddInt32(&v6, 1)
+			return nil
+		})
+		c.UpdateGame(LeagueGame{ID: 1})
+		c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{tcp4, tcp6})
+		for i := 0; atomic.LoadInt32(&v6) < 4; i++ {
+			if i == 5000 {
+				t.Fatal("IPv6 address not rechecked")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		g, _ = c.GetGame(GameKey{ID: 1})
+		return atomic.LoadInt32(&v4), atomic.LoadInt32(&v6), g
+	}
+
+	if v4, _, _ := run(false); v4 != 1 {
+		t.Errorf("IPv4 checked %d times without racing, want 1", v4)
+	}
+	// with racing, the IPv4 address is checked together with the IPv6 one
+	v4, v6, g := run(true)
+	if v4 < v6-1 {
+		t.Errorf("IPv4 checked %d times, IPv6 %d times", v4, v6)
+	}
+	// the results are still recorded per address
+	if a := g.Addrs[cacheAddrKey(tcp4)]; a.Status != ConnectStatusFailure {
+		t.Errorf("IPv4 address has status %v, want failure", a.Status)
+	}
+	if a := g.Addrs[cacheAddrKey(tcp6)]; a.Status != ConnectStatusSuccess {
+		t.Errorf("IPv6 address has status %v, want success", a.Status)
+	}
+	if s4, s6 := g.IPv4Reachability(), g.IPv6Reachability(); s4 != ConnectStatusFailure || s6 != ConnectStatusSuccess {
+		t.Errorf("got IPv4 %v and IPv6 %v, want failure and success", s4, s6)
+	}
+}
+
+func TestCacheDeduplicatesAddrs(t *testing.T) {
+	c := NewCache()
+	defer c.Close()
+	updates := c.GameUpdates.RegisterBlocking()
+	checks := make(chan string, 10)
+	c.Checker = connectChecker(func(ctx context.Context, addr net.Addr) error {
+		checks <- cacheAddrKey(addr)
+		return nil
+	})
+
+	c.UpdateGame(LeagueGame{ID: 1})
+	<-updates // game added
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11113},
+		&net.TCPAddr{IP: net.ParseIP("2001:0db8:0::1"), Port: 11113},
+		&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11113},
+	})
+	// one update for the new addresses and one per finished check
+	for i := 0; i < 3; i++ {
+		select {
+		case <-updates:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for check results")
+		}
+	}
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11113},
+		&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11113},
+	})
+
+	g, _ := c.GetGame(GameKey{ID: 1})
+	if len(g.Addrs) != 2 {
+		t.Errorf("got %d addresses, want 2", len(g.Addrs))
+	}
+	close(checks)
+	count := make(map[string]int)
+	for key := range checks {
+		count[key]++
+	}
+	if len(count) != 2 || count["tcp:[2001:db8::1]:11113"] != 1 || count["udp:[2001:db8::1]:11113"] != 1 {
+		t.Errorf("unexpected checks %v", count)
+	}
+}
+
+func TestCacheRemovesVanishedAddrs(t *testing.T) {
+	c := NewCache()
+	defer c.Close()
+	updates := c.GameUpdates.RegisterBlocking()
+	c.Checker = connectChecker(func(ctx context.Context, addr net.Addr) error {
+		return errors.New("unreachable")
+	})
+	tcp := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}
+	udp := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}
+	private := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 11113}
+
+	c.UpdateGame(LeagueGame{ID: 1})
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{tcp, udp})
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{tcp, private})
+
+	g, _ := c.GetGame(GameKey{ID: 1})
+	if _, ok := g.Addrs[cacheAddrKey(udp)]; ok || len(g.Addrs) != 1 {
+		t.Errorf("unexpected addresses %v", g.Addrs)
+	}
+	// subscribers are notified about the removal; check results for
+	// both addresses may arrive before
+	for {
+		select {
+		case u := <-updates:
+			if _, ok := u.G.Addrs[cacheAddrKey(udp)]; !ok && len(u.G.Addrs) > 0 {
+				if len(u.G.Addrs) != 1 {
+					t.Errorf("update has %d addresses, want 1", len(u.G.Addrs))
+				}
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for update")
+		}
+	}
+}
+
+func TestCacheCancelsChecks(t *testing.T) {
+	c := NewCache()
+	started := make(chan struct{}, 10)
+	cancelled := make(chan string, 10)
+	c.Checker = connectChecker(func(ctx context.Context, addr net.Addr) error {
+		started <- struct{}{}
+		<-ctx.Done()
+		cancelled <- addr.String()
+		return ctx.Err()
+	})
+	wait := func(what string) string {
+		select {
+		case addr := <-cancelled:
+			return addr
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: check was not cancelled", what)
+			return ""
+		}
+	}
+	tcp := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}
+	udp := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11114}
+
+	c.UpdateGame(LeagueGame{ID: 1})
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{tcp, udp})
+	<-started
+	<-started
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{tcp})
+	if addr := wait("removed address"); addr != udp.String() {
+		t.Errorf("cancelled %s, want %s", addr, udp)
+	}
+	c.DeleteGame(GameKey{ID: 1})
+	if addr := wait("deleted game"); addr != tcp.String() {
+		t.Errorf("cancelled %s, want %s", addr, tcp)
+	}
+
+	c.UpdateGame(LeagueGame{ID: 2})
+	c.UpdateAddrs(GameKey{ID: 2}, []net.Addr{tcp})
+	<-started
+	start := time.Now()
+	c.Close()
+	wait("shutdown")
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Close took %v", d)
+	}
+}
+
+func TestCacheItemJoinStatus(t *testing.T) {
+	tcp := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}
+	item := func(status ConnectStatus, joinAllowed, passwordNeeded bool) CacheItem {
+		g := CacheItem{Addrs: map[string]CacheItemAddr{
+			cacheAddrKey(tcp): {Addr: tcp, Status: status},
+		}}
+		g.Game.Flags.JoinAllowed = joinAllowed
+		g.Game.Flags.PasswordNeeded = passwordNeeded
+		return g
+	}
+
+	tests := []struct {
+		name     string
+		g        CacheItem
+		joinable bool
+	}{
+		{"open", item(ConnectStatusSuccess, true, false), true},
+		{"password", item(ConnectStatusSuccess, true, true), true},
+		{"reachable but closed", item(ConnectStatusSuccess, false, false), false},
+		{"unreachable", item(ConnectStatusFailure, true, false), false},
+		{"pending", item(ConnectStatusPending, true, false), false},
+	}
+	for _, test := range tests {
+		s := test.g.JoinStatus()
+		if s.Joinable() != test.joinable {
+			t.Errorf("%s: Joinable() = %v, want %v", test.name, s.Joinable(), test.joinable)
+		}
+		if s.Reachability != test.g.Reachability() || s.JoinAllowed != test.g.Game.Flags.JoinAllowed || s.PasswordNeeded != test.g.Game.Flags.PasswordNeeded {
+			t.Errorf("%s: unexpected status %+v", test.name, s)
+		}
+	}
+}
+
+func TestCacheSubscribe(t *testing.T) {
+	c := NewCache()
+	const n = 1000
+	go func() {
+		for i := 1; i <= n; i++ {
+			c.UpdateGame(LeagueGame{ID: 1, MaxPlayers: i})
+		}
+	}()
+	// wait for the first update so that the snapshot isn't empty
+	for {
+		if _, ok := c.GetGame(GameKey{ID: 1}); ok {
+			break
+		}
+	}
+
+	games, updates := c.Subscribe()
+	defer c.GameUpdates.Unregister(updates)
+	last := games[GameKey{ID: 1}].Game.MaxPlayers
+	if last < n {
+		// the first update must follow the snapshot without a gap
+		if u := <-updates; u == nil || u.G.Game.MaxPlayers != last+1 {
+			t.Errorf("got update %+v after snapshot with %d", u, last)
+		}
+	}
+
+	c.Close()
+	if games, updates := c.Subscribe(); games != nil {
+		t.Errorf("Subscribe after Close returned %v", games)
+	} else if _, ok := <-updates; ok {
+		t.Error("Subscribe after Close returned an open channel")
+	}
+}
+
+func TestCacheDuplicateIDs(t *testing.T) {
+	var mu sync.Mutex
+	var warnings []*log.Entry
+	oldLog := log.Log
+	log.Log = &log.Logger{
+		Handler: log.HandlerFunc(func(e *log.Entry) error {
+			mu.Lock()
+			defer mu.Unlock()
+			warnings = append(warnings, e)
+			return nil
+		}),
+		Level: log.WarnLevel,
+	}
+	defer func() { log.Log = oldLog }()
+
+	c := NewCache()
+	defer c.Close()
+	var games []LeagueGame
+	if err := json.Unmarshal([]byte(`[{"id": 1, "title": "foo"}, {"id": 2}, {"id": 1, "title": "bar"}]`), &games); err != nil {
+		t.Fatal(err)
+	}
+	c.UpdateAllGames(games)
+	if g := c.Get(); len(g) != 2 || g[GameKey{ID: 1}].Game.Title != "bar" {
+		t.Errorf("unexpected games %+v", g)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(warnings) != 1 || warnings[0].Fields["id"] != 1 {
+		t.Errorf("got warnings %+v, want one for id 1", warnings)
+	}
+}
+
+func TestCacheHistory(t *testing.T) {
+	c := NewCache()
+	defer c.Close()
+	c.Checker = connectChecker(func(ctx context.Context, addr net.Addr) error { return nil })
+	c.UpdateGame(LeagueGame{ID: 1})
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113},
+		&net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113},
+	})
+	for i := 0; i < 1000; i++ {
+		if g, _ := c.GetGame(GameKey{ID: 1}); !hasPendingAddrs(map[GameKey]CacheItem{{ID: 1}: g}) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// a game that never changes has a single entry
+	g, _ := c.GetGame(GameKey{ID: 1})
+	if len(g.History) != 1 || g.History[0].Status != ConnectStatusSuccess || g.History[0].Time.IsZero() {
+		t.Errorf("unexpected history %+v", g.History)
+	}
+}
+
+func TestCacheUpdateReachability(t *testing.T) {
+	oldLength := historyLength
+	historyLength = 3
+	defer func() { historyLength = oldLength }()
+
+	addr := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}
+	key := cacheAddrKey(addr)
+	c := &Cache{games: map[GameKey]CacheItem{{ID: 1}: {Addrs: map[string]CacheItemAddr{key: {Addr: addr}}}}, ReachabilityFlips: NewNotifier[*ReachabilityFlip]()}
+	start := time.Now()
+	for i, s := range []ConnectStatus{
+		ConnectStatusPending, // not recorded
+		ConnectStatusFailure,
+		ConnectStatusSuccess,
+		ConnectStatusSuccess, // unchanged
+		ConnectStatusFailure,
+		ConnectStatusSuccess,
+	} {
+		c.games[GameKey{ID: 1}].Addrs[key] = CacheItemAddr{Addr: addr, Status: s}
+		c.updateReachability(GameKey{ID: 1}, start.Add(time.Duration(i)*time.Second))
+	}
+
+	var statuses []ConnectStatus
+	var times []int
+	for _, h := range c.games[GameKey{ID: 1}].History {
+		statuses = append(statuses, h.Status)
+		times = append(times, int(h.Time.Sub(start)/time.Second))
+	}
+	// the oldest entry is dropped
+	if want := []ConnectStatus{ConnectStatusSuccess, ConnectStatusFailure, ConnectStatusSuccess}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("got history %v, want %v", statuses, want)
+	}
+	if want := []int{2, 4, 5}; !reflect.DeepEqual(times, want) {
+		t.Errorf("got times %v, want %v", times, want)
+	}
+}
+
+func TestCacheReachabilityFlips(t *testing.T) {
+	c := NewCache()
+	defer c.Close()
+	flips := c.ReachabilityFlips.Register()
+	bad := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1}
+	good := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}
+	c.Checker = connectChecker(func(ctx context.Context, addr net.Addr) error {
+		if addr == net.Addr(bad) {
+			return errors.New("unreachable")
+		}
+		return nil
+	})
+	next := func() *ReachabilityFlip {
+		select {
+		case f := <-flips:
+			return f
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for flip")
+		}
+		return nil
+	}
+
+	c.UpdateGame(LeagueGame{ID: 1})
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{bad})
+	// the first check is a flip from pending
+	if f := next(); f.Key.ID != 1 || f.From != ConnectStatusPending || f.To != ConnectStatusFailure {
+		t.Errorf("unexpected flip %+v", f)
+	}
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{bad, good})
+	if f := next(); f.Key.ID != 1 || f.From != ConnectStatusFailure || f.To != ConnectStatusSuccess {
+		t.Errorf("unexpected flip %+v", f)
+	}
+
+	// a new listener learns about the last flip right away
+	late := c.ReachabilityFlips.Register()
+	select {
+	case f := <-late:
+		if f.Key.ID != 1 || f.To != ConnectStatusSuccess {
+			t.Errorf("unexpected replayed flip %+v", f)
+		}
+	default:
+		t.Error("last flip wasn't replayed")
+	}
+
+	c.Close()
+	if f, ok := <-flips; ok {
+		t.Errorf("unexpected flip %+v", f)
+	}
+}
+
+func TestCacheReachabilityFlipsOnRemovedAddrs(t *testing.T) {
+	c := NewCache()
+	defer c.Close()
+	flips := c.ReachabilityFlips.Register()
+	c.Checker = connectChecker(func(ctx context.Context, addr net.Addr) error { return nil })
+	next := func() *ReachabilityFlip {
+		select {
+		case f := <-flips:
+			return f
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for flip")
+		}
+		return nil
+	}
+
+	c.UpdateGame(LeagueGame{ID: 1})
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}})
+	if f := next(); f.To != ConnectStatusSuccess {
+		t.Fatalf("unexpected flip %+v", f)
+	}
+	// the only reachable address disappears, no check is involved
+	c.UpdateAddrs(GameKey{ID: 1}, nil)
+	if f := next(); f.Key.ID != 1 || f.From != ConnectStatusSuccess || f.To != ConnectStatusFailure {
+		t.Errorf("unexpected flip %+v", f)
+	}
+	g, _ := c.GetGame(GameKey{ID: 1})
+	if g.reachability != ConnectStatusFailure {
+		t.Errorf("recorded reachability %v, want %v", g.reachability, ConnectStatusFailure)
+	}
+	if n := len(g.History); n != 2 || g.History[n-1].Status != ConnectStatusFailure {
+		t.Errorf("unexpected history %+v", g.History)
+	}
+}
+
+func TestConnectStatusJSON(t *testing.T) {
+	for _, s := range []ConnectStatus{ConnectStatusPending, ConnectStatusSuccess, ConnectStatusFailure} {
+		b, err := json.Marshal(s)
+		if err != nil || string(b) != `"`+s.String()+`"` {
+			t.Errorf("%v: got %s, %v", s, b, err)
+		}
+		var s2 ConnectStatus
+		if err := json.Unmarshal(b, &s2); err != nil || s2 != s {
+			t.Errorf("%s: got %v, %v", b, s2, err)
+		}
+		// legacy integers
+		if err := json.Unmarshal([]byte(fmt.Sprint(int(s))), &s2); err != nil || s2 != s {
+			t.Errorf("%d: got %v, %v", s, s2, err)
+		}
+	}
+
+	// unknown values are encoded, but can't be decoded
+	if b, err := json.Marshal(ConnectStatus(7)); err != nil || string(b) != `"unknown"` {
+		t.Errorf("got %s, %v for unknown status", b, err)
+	}
+	for _, b := range []string{`"unknown"`, `"ok"`, `7`, `-1`, `null`, `true`} {
+		s := ConnectStatusSuccess
+		if err := json.Unmarshal([]byte(b), &s); err == nil || s != ConnectStatusSuccess {
+			t.Errorf("%s: got %v, %v", b, s, err)
+		}
+	}
+}
+
+func TestScheduleNextJitter(t *testing.T) {
+	now := time.Now()
+	times := make(map[time.Time]bool)
+	for i := 0; i < 100; i++ {
+		a := CacheItemAddr{Status: ConnectStatusSuccess}
+		a.scheduleNext(now)
+		if d := a.nextCheck.Sub(now); d < time.Duration(float64(recheckInterval)*(1-recheckJitter)) || d > time.Duration(float64(recheckInterval)*(1+recheckJitter)) {
+			t.Errorf("next check after %v, want %v ± %v%%", d, recheckInterval, recheckJitter*100)
+		}
+		times[a.nextCheck] = true
+	}
+	if len(times) < 50 {
+		t.Errorf("only %d distinct check times for 100 addresses", len(times))
+	}
+
+	oldJitter := recheckJitter
+	recheckJitter = 0
+	defer func() { recheckJitter = oldJitter }()
+	a := CacheItemAddr{Status: ConnectStatusSuccess}
+	a.scheduleNext(now)
+	if d := a.nextCheck.Sub(now); d != recheckInterval {
+		t.Errorf("next check after %v without jitter", d)
+	}
+}
+
+func TestScheduleNextBackoff(t *testing.T) {
+	oldJitter, oldMin, oldMax := recheckJitter, failureBackoffMin, failureBackoffMax
+	recheckJitter, failureBackoffMin, failureBackoffMax = 0, time.Second, 5*time.Second
+	defer func() { recheckJitter, failureBackoffMin, failureBackoffMax = oldJitter, oldMin, oldMax }()
+
+	now := time.Now()
+	a := CacheItemAddr{backoff: failureBackoffMin}
+	tests := []struct {
+		status ConnectStatus
+		delay  time.Duration
+	}{
+		{ConnectStatusFailure, 1 * time.Second},
+		{ConnectStatusFailure, 2 * time.Second},
+		{ConnectStatusFailure, 4 * time.Second},
+		// capped at failureBackoffMax
+		{ConnectStatusFailure, 5 * time.Second},
+		{ConnectStatusFailure, 5 * time.Second},
+		// a success resets the backoff
+		{ConnectStatusSuccess, recheckInterval},
+		{ConnectStatusFailure, 1 * time.Second},
+		{ConnectStatusFailure, 2 * time.Second},
+	}
+	for i, test := range tests {
+		a.Status = test.status
+		a.scheduleNext(now)
+		if d := a.nextCheck.Sub(now); d != test.delay {
+			t.Errorf("%d (%v): next check after %v, want %v", i, test.status, d, test.delay)
+		}
+	}
+}
+
+// fastRechecks makes the cache recheck addresses every few milliseconds
+// without jitter. The returned function restores the defaults.
+func fastRechecks() func() {
+	oldInterval, oldSchedule, oldJitter := recheckInterval, scheduleInterval, recheckJitter
+	recheckInterval, scheduleInterval, recheckJitter = 20*time.Millisecond, 5*time.Millisecond, 0
+	return func() { recheckInterval, scheduleInterval, recheckJitter = oldInterval, oldSchedule, oldJitter }
+}
+
+func TestCacheRechecksAfterInterval(t *testing.T) {
+	defer fastRechecks()()
+
+	c := NewCache()
+	defer c.Close()
+	var checks int32
+	c.Checker = connectChecker(func(ctx context.Context, addr net.Addr) error {
+		atomic.AddInt32(&checks, 1)
+		return nil
+	})
+	c.UpdateGame(LeagueGame{ID: 1})
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}})
+	for i := 0; atomic.LoadInt32(&checks) < 3; i++ {
+		if i == 5000 {
+			t.Fatalf("%d checks, want at least 3", atomic.LoadInt32(&checks))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCacheRechecksDontPileUp(t *testing.T) {
+	defer fastRechecks()()
+
+	c := NewCache()
+	defer c.Close()
+	var checks, running, overlaps int32
+	release := make(chan struct{})
+	c.Checker = connectChecker(func(ctx context.Context, addr net.Addr) error {
+		atomic.AddInt32(&checks, 1)
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		defer atomic.AddInt32(&running, -1)
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return nil
+	})
+	c.UpdateGame(LeagueGame{ID: 1})
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}})
+
+	// several recheck intervals pass while the first check hangs
+	time.Sleep(10 * recheckInterval)
+	if n := atomic.LoadInt32(&checks); n != 1 {
+		t.Errorf("%d checks started while the first one was running, want 1", n)
+	}
+	close(release)
+	for i := 0; atomic.LoadInt32(&checks) < 3; i++ {
+		if i == 5000 {
+			t.Fatalf("%d checks after the first one finished, want at least 3", atomic.LoadInt32(&checks))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&overlaps); n != 0 {
+		t.Errorf("%d checks of one address overlapped", n)
+	}
+}
+
+func TestCacheDeletedGamesArentRechecked(t *testing.T) {
+	defer fastRechecks()()
+
+	c := NewCache()
+	defer c.Close()
+	var checks int32
+	c.Checker = connectChecker(func(ctx context.Context, addr net.Addr) error {
+		atomic.AddInt32(&checks, 1)
+		return nil
+	})
+	c.UpdateGame(LeagueGame{ID: 1})
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}})
+	for i := 0; atomic.LoadInt32(&checks) < 2; i++ {
+		if i == 5000 {
+			t.Fatal("address not rechecked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	c.DeleteGame(GameKey{ID: 1})
+	// let a check that was already handed to a worker finish
+	time.Sleep(recheckInterval)
+	n := atomic.LoadInt32(&checks)
+	time.Sleep(10 * recheckInterval)
+	if m := atomic.LoadInt32(&checks); m != n {
+		t.Errorf("%d checks after deleting the game", m-n)
+	}
+}
+
+func TestCacheCheckGauges(t *testing.T) {
+	oldConcurrency := checkConcurrency
+	checkConcurrency = 1
+	defer func() { checkConcurrency = oldConcurrency }()
+
+	c := NewCache()
+	defer c.Close()
+	release := make(chan struct{})
+	defer close(release)
+	c.Checker = connectChecker(func(ctx context.Context, addr net.Addr) error {
+		<-release
+		return nil
+	})
+	c.UpdateGame(LeagueGame{ID: 1})
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113},
+		&net.TCPAddr{IP: net.ParseIP("1.2.3.5"), Port: 11113},
+		&net.TCPAddr{IP: net.ParseIP("1.2.3.6"), Port: 11113},
+	})
+	for i := 0; c.ActiveChecks() != 1 || c.QueuedChecks() != 2; i++ {
+		if i == 5000 {
+			t.Fatalf("%d active and %d queued checks, want 1 and 2", c.ActiveChecks(), c.QueuedChecks())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCacheSubscribeResync(t *testing.T) {
+	oldSize := gameUpdatesBufSize
+	gameUpdatesBufSize = 25
+	defer func() { gameUpdatesBufSize = oldSize }()
+
+	c := NewCache()
+	defer c.Close()
+	_, updates := c.Subscribe()
+	defer c.GameUpdates.Unregister(updates)
+
+	// an init with more games than the buffer while the subscriber is busy
+	var games []LeagueGame
+	for id := 1; id <= 100; id++ {
+		games = append(games, LeagueGame{ID: id})
+	}
+	c.UpdateAllGames(games)
+	c.Get()
+
+	n := 0
+	for u := range updates {
+		if u.Resync {
+			break
+		}
+		n++
+	}
+	if n != gameUpdatesBufSize {
+		t.Errorf("%d updates before resync, want %d", n, gameUpdatesBufSize)
+	}
+	if g := c.Get(); len(g) != 100 {
+		t.Errorf("%d games after resync, want 100", len(g))
+	}
+	// the subscriber stays registered
+	c.UpdateGame(LeagueGame{ID: 101})
+	if u, ok := <-updates; !ok || u.Key.ID != 101 {
+		t.Errorf("got %+v, %v after resync, want game 101", u, ok)
+	}
+}
+
+func TestCacheForEach(t *testing.T) {
+	c := NewCache()
+	for id := 1; id <= 10; id++ {
+		c.UpdateGame(LeagueGame{ID: id, MaxPlayers: id})
+	}
+	sum := 0
+	c.ForEach(func(g CacheItem) bool {
+		sum += g.Game.MaxPlayers
+		// modifying the copy doesn't affect the cache
+		g.Addrs["x"] = CacheItemAddr{}
+		return true
+	})
+	if sum != 55 {
+		t.Errorf("sum %d, want 55", sum)
+	}
+	if g, _ := c.GetGame(GameKey{ID: 1}); len(g.Addrs) != 0 {
+		t.Errorf("ForEach modified the cache: %+v", g.Addrs)
+	}
+
+	n := 0
+	c.ForEach(func(CacheItem) bool {
+		n++
+		return n < 3
+	})
+	if n != 3 {
+		t.Errorf("%d calls, want 3 until stopped", n)
+	}
+
+	c.Close()
+	c.ForEach(func(CacheItem) bool {
+		t.Error("fn called after Close")
+		return true
+	})
+}
+
+func TestCacheNoPublicAddrs(t *testing.T) {
+	c := NewCache()
+	defer c.Close()
+	c.Checker = connectChecker(func(ctx context.Context, addr net.Addr) error { return nil })
+	c.UpdateGame(LeagueGame{ID: 1})
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 11113},
+		&net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 11113},
+	})
+	g, _ := c.GetGame(GameKey{ID: 1})
+	if !g.NoPublicAddrs || len(g.Addrs) != 0 {
+		t.Errorf("got NoPublicAddrs %v with %d addresses, want true with none", g.NoPublicAddrs, len(g.Addrs))
+	}
+	if ag := newAPIGame(g); !ag.NoPublicAddrs {
+		t.Error("NoPublicAddrs missing in the API")
+	}
+
+	// no addresses at all are a different case
+	c.UpdateAddrs(GameKey{ID: 1}, nil)
+	if g, _ := c.GetGame(GameKey{ID: 1}); g.NoPublicAddrs {
+		t.Error("NoPublicAddrs set without any addresses")
+	}
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}})
+	if g, _ := c.GetGame(GameKey{ID: 1}); g.NoPublicAddrs {
+		t.Error("NoPublicAddrs set with a public address")
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	c := NewCache()
+	c.Checker = connectChecker(func(ctx context.Context, addr net.Addr) error {
+		if addr.(*net.TCPAddr).IP.Equal(net.ParseIP("1.2.3.5")) {
+			return errors.New("refused")
+		}
+		return nil
+	})
+	c.UpdateGame(LeagueGame{ID: 1})
+	c.UpdateGame(LeagueGame{ID: 2})
+	c.UpdateGame(LeagueGame{ID: 3})
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113},
+		&net.TCPAddr{IP: net.ParseIP("1.2.3.5"), Port: 11113},
+	})
+	c.UpdateAddrs(GameKey{ID: 2}, []net.Addr{&net.TCPAddr{IP: net.ParseIP("1.2.3.6"), Port: 11113}})
+
+	var s CacheStats
+	for i := 0; ; i++ {
+		s = c.Stats()
+		if s.AddrsPending == 0 && s.ActiveChecks == 0 {
+			break
+		}
+		if i == 5000 {
+			t.Fatalf("checks didn't finish: %+v", s)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	want := CacheStats{Games: 3, GamesWithoutAddrs: 1, Addrs: 3, AddrsSuccess: 2, AddrsFailure: 1}
+	if s != want {
+		t.Errorf("got %+v, want %+v", s, want)
+	}
+
+	c.DeleteGame(GameKey{ID: 1})
+	if s := c.Stats(); s.Games != 2 || s.Addrs != 1 {
+		t.Errorf("got %+v after delete, want 2 games with 1 address", s)
+	}
+
+	c.Close()
+	if s := c.Stats(); s != (CacheStats{}) {
+		t.Errorf("got %+v after Close, want zero", s)
+	}
+}
+
+func TestCacheQueuedChecksDontTimeOut(t *testing.T) {
+	oldConcurrency, oldTimeout := checkConcurrency, pendingTimeout
+	checkConcurrency, pendingTimeout = 1, 10*time.Millisecond
+	defer func() { checkConcurrency, pendingTimeout = oldConcurrency, oldTimeout }()
+
+	c := NewCache()
+	defer c.Close()
+	release := make(chan struct{})
+	defer close(release)
+	// the single worker is stuck on the first check
+	c.Checker = connectChecker(func(ctx context.Context, addr net.Addr) error {
+		<-release
+		return nil
+	})
+	first := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}
+	second := &net.TCPAddr{IP: net.ParseIP("1.2.3.5"), Port: 11113}
+	c.UpdateGame(LeagueGame{ID: 1})
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{first})
+	for i := 0; c.ActiveChecks() != 1; i++ {
+		if i == 5000 {
+			t.Fatal("first check not started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.UpdateGame(LeagueGame{ID: 2})
+	c.UpdateAddrs(GameKey{ID: 2}, []net.Addr{second})
+
+	// wait until the running check times out
+	for i := 0; ; i++ {
+		g, _ := c.GetGame(GameKey{ID: 1})
+		if a := g.Addrs[cacheAddrKey(first)]; a.Reason == checkTimeoutReason {
+			break
+		}
+		if i == 5000 {
+			t.Fatal("running check didn't time out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	g, _ := c.GetGame(GameKey{ID: 2})
+	if a := g.Addrs[cacheAddrKey(second)]; a.Status != ConnectStatusPending {
+		t.Errorf("queued check has status %v (%q), want pending", a.Status, a.Reason)
+	}
+}
+
+func TestCacheHangingCheckTimesOut(t *testing.T) {
+	oldTimeout, oldSchedule := pendingTimeout, scheduleInterval
+	pendingTimeout, scheduleInterval = 20*time.Millisecond, 5*time.Millisecond
+	defer func() { pendingTimeout, scheduleInterval = oldTimeout, oldSchedule }()
+
+	c := NewCache()
+	defer c.Close()
+	cancelled := make(chan struct{}, 1)
+	// the check only returns once its context is cancelled
+	c.Checker = connectChecker(func(ctx context.Context, addr net.Addr) error {
+		<-ctx.Done()
+		cancelled <- struct{}{}
+		return ctx.Err()
+	})
+	addr := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}
+	c.UpdateGame(LeagueGame{ID: 1})
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{addr})
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("hanging check was not cancelled")
+	}
+	g, _ := c.GetGame(GameKey{ID: 1})
+	if a := g.Addrs[cacheAddrKey(addr)]; a.Status != ConnectStatusFailure || a.Reason != checkTimeoutReason {
+		t.Errorf("got status %v (%q), want failure (%q)", a.Status, a.Reason, checkTimeoutReason)
+	}
+	if s := g.Reachability(); s != ConnectStatusFailure {
+		t.Errorf("game reachability %v, want failure", s)
+	}
+}
+
+func TestCacheDropsCancelledQueuedChecks(t *testing.T) {
+	oldConcurrency := checkConcurrency
+	checkConcurrency = 1
+	defer func() { checkConcurrency = oldConcurrency }()
+
+	c := NewCache()
+	defer c.Close()
+	blocking := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}
+	addr := &net.TCPAddr{IP: net.ParseIP("1.2.3.5"), Port: 11113}
+	release := make(chan struct{})
+	var checks int32
+	c.Checker = connectChecker(func(ctx context.Context, a net.Addr) error {
+		if a.String() == blocking.String() {
+			<-release
+			return nil
+		}
+		if a.String() != addr.String() {
+			return nil
+		}
+		atomic.AddInt32(&checks, 1)
+		return ctx.Err()
+	})
+	c.UpdateGame(LeagueGame{ID: 1})
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{blocking})
+	for i := 0; c.ActiveChecks() != 1; i++ {
+		if i == 5000 {
+			t.Fatal("first check not started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// another check waiting in front keeps the cancelled one in the queue
+	c.UpdateGame(LeagueGame{ID: 3})
+	c.UpdateAddrs(GameKey{ID: 3}, []net.Addr{&net.TCPAddr{IP: net.ParseIP("1.2.3.6"), Port: 11113}})
+	// the queued check is cancelled and the address scheduled again
+	c.UpdateGame(LeagueGame{ID: 2})
+	c.UpdateAddrs(GameKey{ID: 2}, []net.Addr{addr})
+	c.UpdateAddrs(GameKey{ID: 2}, nil)
+	c.UpdateAddrs(GameKey{ID: 2}, []net.Addr{addr})
+	c.Get()
+	if n := c.QueuedChecks(); n != 2 {
+		t.Errorf("%d queued checks, want 2", n)
+	}
+	close(release)
+
+	for i := 0; ; i++ {
+		g, _ := c.GetGame(GameKey{ID: 2})
+		if a := g.Addrs[cacheAddrKey(addr)]; a.Status != ConnectStatusPending {
+			if a.Status != ConnectStatusSuccess {
+				t.Errorf("got status %v (%q), want success", a.Status, a.Reason)
+			}
+			break
+		}
+		if i == 5000 {
+			t.Fatal("address not checked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&checks); n != 1 {
+		t.Errorf("%d checks, want 1", n)
+	}
+}
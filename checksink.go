@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// CheckResult describes a completed connection check.
+type CheckResult struct {
+	Key     GameKey
+	Addr    net.Addr
+	Status  ConnectStatus // success or failure
+	Err     error         // reason for a failure
+	Time    time.Time     // time the check completed
+	Latency time.Duration // duration of the check
+	Punch   PunchOutcome  // for netpuncher addresses
+}
+
+// CheckSink receives the results of all connection checks, e.g. to store them
+// for analytics. Record is called from the check workers, so it must be safe
+// for concurrent use and should return quickly.
+type CheckSink interface {
+	Record(CheckResult)
+}
+
+// CheckSinkFunc adapts a function to a CheckSink.
+type CheckSinkFunc func(CheckResult)
+
+func (f CheckSinkFunc) Record(r CheckResult) { f(r) }
+
+// nopCheckSink is the default CheckSink, which discards all results.
+type nopCheckSink struct{}
+
+func (nopCheckSink) Record(CheckResult) {}
+
+// PunchOutcome describes how far a netpuncher check got.
+type PunchOutcome string
+
+const (
+	PunchNone      PunchOutcome = ""             // not a netpuncher address
+	PunchSuccess   PunchOutcome = "punched"      // the host was reached
+	PunchNoRequest PunchOutcome = "no_request"   // the netpuncher didn't relay a request from the host
+	PunchFailed    PunchOutcome = "punch_failed" // the host's address was relayed, but punching failed
+	PunchError     PunchOutcome = "error"        // the netpuncher couldn't be contacted, or the check was cancelled
+)
+
+// punchError is returned by tryConnectNetpuncher for failures after the
+// request was sent to the netpuncher.
+type punchError struct {
+	outcome PunchOutcome
+	err     error
+}
+
+func (e *punchError) Error() string { return e.err.Error() }
+func (e *punchError) Unwrap() error { return e.err }
+
+// punchOutcome returns the outcome of a check of addr that returned err.
+func punchOutcome(addr net.Addr, err error) PunchOutcome {
+	if _, ok := addr.(*NetpuncherAddr); !ok {
+		return PunchNone
+	}
+	if err == nil {
+		return PunchSuccess
+	}
+	var pe *punchError
+	if errors.As(err, &pe) {
+		return pe.outcome
+	}
+	return PunchError
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCacheCheckSink(t *testing.T) {
+	c := NewCache()
+	defer c.Close()
+	results := make(chan CheckResult, 10)
+	c.Checks = CheckSinkFunc(func(r CheckResult) { results <- r })
+	c.Checker = connectChecker(func(ctx context.Context, addr net.Addr) error {
+		return &punchError{PunchFailed, errors.New("no answer")}
+	})
+	addr := &NetpuncherAddr{Net: "netpuncher4", Addr: "invalid", ID: 7}
+	c.UpdateGame(LeagueGame{ID: 1})
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{addr})
+
+	select {
+	case r := <-results:
+		if r.Key != (GameKey{ID: 1}) || r.Addr != addr || r.Status != ConnectStatusFailure || r.Err == nil || r.Time.IsZero() || r.Latency < 0 {
+			t.Errorf("unexpected result %+v", r)
+		}
+		if r.Punch != PunchFailed {
+			t.Errorf("punch outcome %q, want %q", r.Punch, PunchFailed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no check result recorded")
+	}
+}
+
+func TestPunchOutcome(t *testing.T) {
+	np := &NetpuncherAddr{Net: "netpuncher4", Addr: "invalid", ID: 7}
+	tcp := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}
+	for _, test := range []struct {
+		addr net.Addr
+		err  error
+		want PunchOutcome
+	}{
+		{tcp, nil, PunchNone},
+		{tcp, errors.New("refused"), PunchNone},
+		{np, nil, PunchSuccess},
+		{np, &punchError{PunchNoRequest, errors.New("timeout")}, PunchNoRequest},
+		{np, &punchError{PunchFailed, errors.New("timeout")}, PunchFailed},
+		{np, context.Canceled, PunchError},
+	} {
+		if got := punchOutcome(test.addr, test.err); got != test.want {
+			t.Errorf("punchOutcome(%v, %v) = %q, want %q", test.addr, test.err, got, test.want)
+		}
+	}
+}
@@ -1,17 +1,35 @@
 package main
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/apex/log"
 	"github.com/openclonk/netpuncher"
 	"github.com/openclonk/netpuncher/c4netioudp"
+	"golang.org/x/net/proxy"
 )
 
+// connectTimeout limits each connection attempt. For netpuncher addresses, it
+// applies to both the netpuncher request and the punching.
 var connectTimeout = 5 * time.Second
 
+// udpPings is the number of pings sent for a UDP check. They are evenly spaced
+// within connectTimeout.
+var udpPings = 3
+
+// allowPrivate enables checking private, loopback and link-local addresses,
+// e.g. for monitoring games in a LAN.
+var allowPrivate = false
+
 var privateIPBlocks []*net.IPNet
 
 func init() {
@@ -35,20 +53,50 @@ func init() {
 	}
 }
 
-// shouldSkipAddr checks for local addresses that should not be tested.
+// invalidIPReason returns why ip can never be the address of a game, or an
+// empty string if it might be.
+func invalidIPReason(ip net.IP) string {
+	switch {
+	case ip == nil:
+		return "missing"
+	case ip.IsUnspecified():
+		return "unspecified"
+	case ip.IsMulticast():
+		return "multicast"
+	case ip.Equal(net.IPv4bcast):
+		return "broadcast"
+	}
+	return ""
+}
+
+// shouldSkipAddr checks for invalid addresses, for local addresses that should
+// not be tested (unless allowPrivate is set), and for addresses that can't be
+// tested through checkProxy.
 func shouldSkipAddr(addr net.Addr) bool {
 	var ip net.IP
 	switch a := addr.(type) {
 	case *net.TCPAddr:
 		ip = a.IP
 	case *net.UDPAddr:
+		if checkProxy != nil {
+			return true
+		}
 		ip = a.IP
 	case *NetpuncherAddr:
-		return false
+		return checkProxy != nil
 	default:
 		// unknown address type, skip
 		return true
 	}
+	if reason := invalidIPReason(ip); reason != "" {
+		log.WithFields(log.Fields{"addr": addr.String(), "reason": reason}).Debug("shouldSkipAddr: skipping invalid address")
+		return true
+	}
+	if allowPrivate {
+		// loopback and link-local aren't global unicast, but are
+		// reachable in a LAN as well
+		return !ip.IsGlobalUnicast() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast()
+	}
 	if !ip.IsGlobalUnicast() {
 		return true
 	}
@@ -60,46 +108,213 @@ func shouldSkipAddr(addr net.Addr) bool {
 	return false
 }
 
-// tryConnect attempts to connect to the given address, returning true if the
-// connection succeeds.
-func tryConnect(addr net.Addr) bool {
+// dialProxy connects through the given proxy, giving up after connectTimeout
+// or when ctx is cancelled if the proxy supports contexts.
+func dialProxy(ctx context.Context, d proxy.Dialer, network, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+	if cd, ok := d.(proxy.ContextDialer); ok {
+		return cd.DialContext(ctx, network, addr)
+	}
+	return d.Dial(network, addr)
+}
+
+// Checker checks whether addr is reachable, returning the resulting status,
+// the time the check took and the reason for a failure. Cancelling ctx aborts
+// the check.
+type Checker func(ctx context.Context, addr net.Addr) (ConnectStatus, time.Duration, error)
+
+// defaultChecker is the Checker of new caches. The -dry-run flag replaces it.
+var defaultChecker = connectChecker(tryConnect)
+
+// connectChecker returns a Checker that succeeds if connect does.
+func connectChecker(connect func(context.Context, net.Addr) error) Checker {
+	return func(ctx context.Context, addr net.Addr) (ConnectStatus, time.Duration, error) {
+		start := time.Now()
+		if err := connect(ctx, addr); err != nil {
+			return ConnectStatusFailure, time.Since(start), err
+		}
+		return ConnectStatusSuccess, time.Since(start), nil
+	}
+}
+
+// dryRunChecker returns a Checker that reports the given status (in its
+// String() form) for every address without sending anything.
+func dryRunChecker(status string) (Checker, error) {
+	cs, err := parseConnectStatus(status)
+	if err != nil {
+		return nil, err
+	}
+	var reason error
+	if cs == ConnectStatusFailure {
+		reason = errors.New("dry run")
+	}
+	return func(context.Context, net.Addr) (ConnectStatus, time.Duration, error) {
+		return cs, 0, reason
+	}, nil
+}
+
+// tryConnect attempts to connect to the given address, returning nil if the
+// connection succeeds or the reason for the failure otherwise. Cancelling ctx
+// aborts the attempt.
+func tryConnect(ctx context.Context, addr net.Addr) error {
 	switch a := addr.(type) {
 	case *net.TCPAddr:
-		return tryConnectTCP(a)
+		return tryConnectTCP(ctx, a)
 	case *net.UDPAddr:
-		return tryConnectUDP(a)
+		return tryConnectUDP(ctx, a)
 	case *NetpuncherAddr:
-		return tryConnectNetpuncher(a)
+		return tryConnectNetpuncher(ctx, a)
 	default:
-		return false
+		return fmt.Errorf("unsupported address type %T", addr)
 	}
 }
 
-func tryConnectTCP(addr *net.TCPAddr) bool {
-	conn, err := net.DialTimeout("tcp", addr.String(), connectTimeout)
+// checkProxy routes TCP checks through a proxy if set. UDP and netpuncher
+// addresses can't be checked through it and are skipped instead.
+var checkProxy proxy.Dialer
+
+// setCheckProxy sets checkProxy from a URL such as socks5://host:1080.
+func setCheckProxy(rawurl string) error {
+	u, err := url.Parse(rawurl)
 	if err != nil {
-		return false
+		return err
+	}
+	checkProxy, err = proxy.FromURL(u, proxy.Direct)
+	return err
+}
+
+// Dialer establishes the connections for TCP and UDP checks. *net.Dialer
+// implements it.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// checkDialer is the Dialer for TCP and UDP checks.
+var checkDialer Dialer = &net.Dialer{}
+
+// localDialer binds connections to a local IP address.
+type localDialer struct {
+	ip net.IP
+}
+
+// NewLocalDialer returns a Dialer whose connections originate from the given
+// local IP address.
+func NewLocalDialer(ip net.IP) Dialer {
+	return &localDialer{ip: ip}
+}
+
+func (d *localDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var nd net.Dialer
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		nd.LocalAddr = &net.TCPAddr{IP: d.ip}
+	case "udp", "udp4", "udp6":
+		nd.LocalAddr = &net.UDPAddr{IP: d.ip}
+	}
+	return nd.DialContext(ctx, network, address)
+}
+
+// dial connects with checkDialer, giving up after connectTimeout.
+func dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+	return checkDialer.DialContext(ctx, network, addr)
+}
+
+// closeOnCancel closes c when ctx is cancelled, unblocking any reads and
+// writes. Call stop once c isn't used anymore.
+func closeOnCancel(ctx context.Context, c io.Closer) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+func tryConnectTCP(ctx context.Context, addr *net.TCPAddr) error {
+	var conn net.Conn
+	var err error
+	if checkProxy != nil {
+		conn, err = dialProxy(ctx, checkProxy, "tcp", addr.String())
+	} else {
+		conn, err = dial(ctx, "tcp", addr.String())
+	}
+	if err != nil {
+		return err
 	}
 	conn.Close()
-	return true
+	return nil
 }
 
-func tryConnectUDP(addr *net.UDPAddr) bool {
+func tryConnectUDP(ctx context.Context, addr *net.UDPAddr) error {
 	hdr := c4netioudp.PacketHdr{StatusByte: c4netioudp.IPID_Ping}
-	conn, err := net.DialUDP("udp", nil, addr)
+	conn, err := dial(ctx, "udp", addr.String())
 	if err != nil {
-		return false
+		return err
 	}
 	defer conn.Close()
-	hdr.WriteTo(conn)
-	conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	defer closeOnCancel(ctx, conn)()
+	// UDP is lossy, so send several pings spread over connectTimeout
+	pings := udpPings
+	if pings < 1 {
+		pings = 1
+	}
+	deadline := time.Now().Add(connectTimeout)
+	conn.SetWriteDeadline(deadline)
+	interval := connectTimeout / time.Duration(pings)
+	for i := 0; i < pings; i++ {
+		hdr.WriteTo(conn)
+		next := deadline
+		if i < pings-1 {
+			next = time.Now().Add(interval)
+		}
+		conn.SetReadDeadline(next)
+		err = readPingReply(conn)
+		if err == nil {
+			return nil
+		}
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			break
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf("no ping reply: %w", err)
+}
+
+// readPingReply reads from conn until it receives a ping reply or the read
+// fails.
+func readPingReply(conn net.Conn) error {
 	buf := make([]byte, 1500)
-	n, addr, err := conn.ReadFromUDP(buf)
-	if err != nil {
-		return false
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		// ignore anything that isn't a ping reply, it may come from
+		// something other than a Clonk host
+		if reply, ok := parsePacketHdr(buf[:n]); ok && reply.StatusByte&0x7f == c4netioudp.IPID_Ping {
+			return nil
+		}
 	}
-	// assume that the connection was successful if we received anything
-	return n > 0
+}
+
+// packetHdrSize is the size of the packed C4NetIOUDP packet header.
+const packetHdrSize = 5
+
+// parsePacketHdr parses a C4NetIOUDP packet header. Clonk hosts reply to a ping
+// with a header only, so longer packets are rejected.
+func parsePacketHdr(b []byte) (c4netioudp.PacketHdr, bool) {
+	if len(b) != packetHdrSize {
+		return c4netioudp.PacketHdr{}, false
+	}
+	return c4netioudp.PacketHdr{StatusByte: b[0], Nr: binary.LittleEndian.Uint32(b[1:])}, true
 }
 
 // NetpuncherAddr is a net.Addr for a netpuncher connection.
@@ -118,40 +333,67 @@ func (a *NetpuncherAddr) String() string {
 	return fmt.Sprintf("%s#%d", a.Addr, a.ID)
 }
 
+// ParseNetpuncherAddr reverses String() for a netpuncher address on the given
+// network, netpuncher4 or netpuncher6.
+func ParseNetpuncherAddr(network, s string) (*NetpuncherAddr, error) {
+	if network != "netpuncher4" && network != "netpuncher6" {
+		return nil, fmt.Errorf("invalid netpuncher network %q", network)
+	}
+	i := strings.LastIndex(s, "#")
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid netpuncher address %q", s)
+	}
+	id, err := strconv.ParseUint(s[i+1:], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid netpuncher address %q: %w", s, err)
+	}
+	return &NetpuncherAddr{Net: network, Addr: s[:i], ID: id}, nil
+}
+
+// Equal returns whether both addresses refer to the same game on the same
+// netpuncher.
+func (a *NetpuncherAddr) Equal(b *NetpuncherAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Net == b.Net && a.Addr == b.Addr && a.ID == b.ID
+}
+
 const (
 	punchInterval = 100 * time.Millisecond
 )
 
-func tryConnectNetpuncher(a *NetpuncherAddr) bool {
+func tryConnectNetpuncher(ctx context.Context, a *NetpuncherAddr) error {
 	network := "udp"
-	raddr, err := net.ResolveUDPAddr(network, a.Addr)
+	raddr, err := resolver.ResolveUDPAddr(a.Addr)
 	if err != nil {
-		log.WithError(err).WithField("addr", a.Addr).Errorf("tryConnectNetpuncher: invalid netpuncher address")
-		return false
+		return fmt.Errorf("invalid netpuncher address: %w", err)
 	}
 	listener, err := c4netioudp.Listen(network, nil)
 	if err != nil {
-		log.WithError(err).Error("tryConnectNetpuncher: c4netioudp Listen failed")
-		return false
+		return fmt.Errorf("c4netioudp Listen failed: %w", err)
 	}
 	defer listener.Close()
+	defer closeOnCancel(ctx, listener)()
 
 	conn, err := listener.Dial(raddr)
 	if err != nil {
-		log.WithError(err).Error("tryConnectNetpuncher: c4netioudp Dial failed")
-		return false
+		return fmt.Errorf("c4netioudp Dial failed: %w", err)
 	}
 	defer conn.Close()
+	defer closeOnCancel(ctx, conn)()
 
 	// The following uses version 1 of the netpuncher protocol.
+	// TODO: Support version 2 once the netpuncher library implements it; the
+	// pinned version only speaks version 1. The version should then come from
+	// the league answer, falling back to version 1 if it's unknown.
 	header := netpuncher.Header{Version: 1}
 
 	// Request punching for the given host id.
 	sreq := netpuncher.SReq{Header: header, CID: uint32(a.ID)}
 	b, err := sreq.MarshalBinary()
 	if err != nil {
-		log.WithError(err).Error("tryConnectNetpuncher: SReq.MarshalBinary failed")
-		return false
+		return fmt.Errorf("SReq.MarshalBinary failed: %w", err)
 	}
 	conn.Write(b)
 	log.WithField("packet", fmt.Sprintf("%+v", sreq)).Debugf("tryConnectNetpuncher: -> %T", sreq)
@@ -160,9 +402,11 @@ func tryConnectNetpuncher(a *NetpuncherAddr) bool {
 
 	for {
 		msg, err := netpuncher.ReadFrom(conn)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if err != nil {
-			log.WithError(err).Error("tryConnectNetpuncher: reading from netpuncher failed")
-			return false
+			return &punchError{PunchNoRequest, fmt.Errorf("reading from netpuncher failed: %w", err)}
 		}
 		switch np := msg.(type) {
 		case *netpuncher.AssID:
@@ -171,11 +415,13 @@ func tryConnectNetpuncher(a *NetpuncherAddr) bool {
 			log.WithField("packet", fmt.Sprintf("%+v", msg)).Debugf("tryConnectNetpuncher: <- %T", msg)
 			// Try to establish communication.
 			if err = listener.Punch(&np.Addr, connectTimeout, punchInterval); err != nil {
-				log.WithError(err).WithField("raddr", np.Addr.String()).Error("tryConnectNetpuncher: punching failed")
-				return false
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return &punchError{PunchFailed, fmt.Errorf("punching %s failed: %w", np.Addr.String(), err)}
 			}
 			// Punching success!
-			return true
+			return nil
 		default:
 			log.WithField("packet", fmt.Sprintf("%+v", msg)).Debugf("tryConnectNetpuncher: <- %T", msg)
 		}
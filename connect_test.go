@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// udpResponder ignores the first drop packets and answers every following
+// packet with the given replies.
+func udpResponder(t *testing.T, drop int, replies ...[]byte) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			_, raddr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if drop > 0 {
+				drop--
+				continue
+			}
+			for _, r := range replies {
+				conn.WriteToUDP(r, raddr)
+			}
+		}
+	}()
+	return conn
+}
+
+func TestTryConnectUDP(t *testing.T) {
+	oldTimeout := connectTimeout
+	connectTimeout = 200 * time.Millisecond
+	defer func() { connectTimeout = oldTimeout }()
+
+	junk := []byte("HTTP/1.1 400 Bad Request\r\n\r\n")
+	wrongType := []byte{3, 0, 0, 0, 0}
+	ping := []byte{0, 0, 0, 0, 0}
+	tests := []struct {
+		name    string
+		replies [][]byte
+		want    bool
+	}{
+		{"junk", [][]byte{junk, wrongType}, false},
+		{"junk before ping", [][]byte{junk, wrongType, ping}, true},
+		{"broadcast ping", [][]byte{{0x80, 0, 0, 0, 0}}, true},
+	}
+	for _, test := range tests {
+		conn := udpResponder(t, 0, test.replies...)
+		if err := tryConnectUDP(context.Background(), conn.LocalAddr().(*net.UDPAddr)); (err == nil) != test.want {
+			t.Errorf("%s: got %v, want success = %v", test.name, err, test.want)
+		}
+		conn.Close()
+	}
+}
+
+func TestTryConnectUDPLoss(t *testing.T) {
+	oldTimeout, oldPings := connectTimeout, udpPings
+	connectTimeout = 300 * time.Millisecond
+	defer func() { connectTimeout, udpPings = oldTimeout, oldPings }()
+	ping := []byte{0, 0, 0, 0, 0}
+
+	udpPings = 1
+	conn := udpResponder(t, 2, ping)
+	if err := tryConnectUDP(context.Background(), conn.LocalAddr().(*net.UDPAddr)); err == nil {
+		t.Error("single ping succeeded although it was dropped")
+	}
+	conn.Close()
+
+	udpPings = 3
+	conn = udpResponder(t, 2, ping)
+	start := time.Now()
+	if err := tryConnectUDP(context.Background(), conn.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Errorf("third ping failed: %v", err)
+	}
+	conn.Close()
+	if d := time.Since(start); d > connectTimeout+100*time.Millisecond {
+		t.Errorf("check took %v", d)
+	}
+}
+
+func TestTryConnectUDPCancel(t *testing.T) {
+	// never answers
+	conn := udpResponder(t, 1000)
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if err := tryConnectUDP(ctx, conn.LocalAddr().(*net.UDPAddr)); err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("cancelled check took %v", d)
+	}
+}
+
+func TestTryConnectReason(t *testing.T) {
+	if err := tryConnect(context.Background(), &NetpuncherAddr{Net: "netpuncher4", Addr: "invalid", ID: 1}); err == nil {
+		t.Error("expected an error for an invalid netpuncher address")
+	}
+	if err := tryConnect(context.Background(), &net.IPAddr{IP: net.IPv4(1, 2, 3, 4)}); err == nil {
+		t.Error("expected an error for an unsupported address type")
+	}
+
+	// a closed port is refused immediately
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	if err := tryConnect(context.Background(), addr); err != nil {
+		t.Errorf("connecting to listener: %v", err)
+	}
+	l.Close()
+	if err := tryConnect(context.Background(), addr); err == nil {
+		t.Error("expected an error for a closed port")
+	}
+}
+
+// socks5Server is a minimal SOCKS5 server without authentication that only
+// supports CONNECT. It counts the accepted connections.
+func socks5Server(t *testing.T, connects *int32) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				// greeting: version, methods
+				buf := make([]byte, 262)
+				if _, err := io.ReadFull(c, buf[:2]); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+					return
+				}
+				c.Write([]byte{5, 0})
+				// request: version, command, reserved, address type
+				if _, err := io.ReadFull(c, buf[:4]); err != nil {
+					return
+				}
+				var host string
+				switch buf[3] {
+				case 1, 4:
+					n := net.IPv4len
+					if buf[3] == 4 {
+						n = net.IPv6len
+					}
+					if _, err := io.ReadFull(c, buf[:n]); err != nil {
+						return
+					}
+					host = net.IP(buf[:n]).String()
+				case 3:
+					if _, err := io.ReadFull(c, buf[:1]); err != nil {
+						return
+					}
+					n := int(buf[0])
+					if _, err := io.ReadFull(c, buf[:n]); err != nil {
+						return
+					}
+					host = string(buf[:n])
+				}
+				if _, err := io.ReadFull(c, buf[:2]); err != nil {
+					return
+				}
+				port := binary.BigEndian.Uint16(buf[:2])
+				target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+				if err != nil {
+					// connection refused
+					c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				target.Close()
+				atomic.AddInt32(connects, 1)
+				c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+			}()
+		}
+	}()
+	return l
+}
+
+func TestTryConnectTCPProxy(t *testing.T) {
+	var connects int32
+	socks := socks5Server(t, &connects)
+	defer socks.Close()
+	if err := setCheckProxy("socks5://" + socks.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { checkProxy = nil }()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	if err := tryConnect(context.Background(), addr); err != nil {
+		t.Errorf("connecting through proxy: %v", err)
+	}
+	if n := atomic.LoadInt32(&connects); n != 1 {
+		t.Errorf("%d connections through the proxy, want 1", n)
+	}
+	l.Close()
+	if err := tryConnect(context.Background(), addr); err == nil {
+		t.Error("expected an error for a closed port")
+	}
+
+	udp := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}
+	np := &NetpuncherAddr{Net: "netpuncher4", Addr: "netpuncher.example:11115", ID: 1}
+	if !shouldSkipAddr(udp) || !shouldSkipAddr(np) {
+		t.Error("UDP and netpuncher addresses must be skipped with a proxy")
+	}
+}
+
+// dialerFunc implements Dialer.
+type dialerFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+// withDialer replaces checkDialer until the returned function is called.
+func withDialer(d Dialer) func() {
+	old := checkDialer
+	checkDialer = d
+	return func() { checkDialer = old }
+}
+
+func TestCheckDialer(t *testing.T) {
+	oldTimeout := connectTimeout
+	connectTimeout = 200 * time.Millisecond
+	defer func() { connectTimeout = oldTimeout }()
+	tcp := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}
+	udp := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}
+
+	var dialed []string
+	refused := errors.New("connection refused")
+	defer withDialer(dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, network+" "+address)
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("dial without deadline")
+		}
+		return nil, refused
+	}))()
+	if err := tryConnect(context.Background(), tcp); err != refused {
+		t.Errorf("TCP: got %v, want %v", err, refused)
+	}
+	if err := tryConnect(context.Background(), udp); err != refused {
+		t.Errorf("UDP: got %v, want %v", err, refused)
+	}
+	if len(dialed) != 2 || dialed[0] != "tcp 1.2.3.4:11113" || dialed[1] != "udp 1.2.3.4:11113" {
+		t.Errorf("dialed %v", dialed)
+	}
+
+	// a host that answers the ping after some junk
+	defer withDialer(dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			buf := make([]byte, packetHdrSize)
+			if _, err := io.ReadFull(server, buf); err != nil {
+				return
+			}
+			server.Write([]byte("junk"))
+			server.Write([]byte{0, 0, 0, 0, 0})
+		}()
+		return client, nil
+	}))()
+	if err := tryConnect(context.Background(), tcp); err != nil {
+		t.Errorf("TCP: %v", err)
+	}
+	if err := tryConnect(context.Background(), udp); err != nil {
+		t.Errorf("UDP: %v", err)
+	}
+}
+
+func TestShouldSkipAddr(t *testing.T) {
+	defer func() { allowPrivate = false }()
+	tcp := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 11113} }
+	np := &NetpuncherAddr{Net: "netpuncher4", Addr: "netpuncher.example:11115", ID: 1}
+
+	tests := []struct {
+		addr        net.Addr
+		skip        bool // by default
+		skipWithLAN bool // with allowPrivate
+	}{
+		{tcp("1.2.3.4"), false, false},
+		{tcp("2001:db8::1"), false, false},
+		{tcp("192.168.0.1"), true, false},
+		{tcp("10.0.0.1"), true, false},
+		{tcp("127.0.0.1"), true, false},
+		{tcp("fe80::1"), true, false},
+		{tcp("fd00::1"), true, false},
+		{np, false, false},
+		{&net.IPAddr{IP: net.ParseIP("1.2.3.4")}, true, true},
+	}
+	for _, test := range tests {
+		allowPrivate = false
+		if skip := shouldSkipAddr(test.addr); skip != test.skip {
+			t.Errorf("%v: got %v, want %v", test.addr, skip, test.skip)
+		}
+		allowPrivate = true
+		if skip := shouldSkipAddr(test.addr); skip != test.skipWithLAN {
+			t.Errorf("%v with allowPrivate: got %v, want %v", test.addr, skip, test.skipWithLAN)
+		}
+	}
+}
+
+func TestShouldSkipInvalidAddr(t *testing.T) {
+	defer func() { allowPrivate = false }()
+	tests := []struct {
+		ip     string
+		reason string
+	}{
+		{"0.0.0.0", "unspecified"},
+		{"::", "unspecified"},
+		{"224.0.0.1", "multicast"},
+		{"239.1.2.3", "multicast"},
+		{"ff02::1", "multicast"},
+		{"255.255.255.255", "broadcast"},
+		{"1.2.3.4", ""},
+	}
+	for _, test := range tests {
+		ip := net.ParseIP(test.ip)
+		if reason := invalidIPReason(ip); reason != test.reason {
+			t.Errorf("%s: got reason %q, want %q", test.ip, reason, test.reason)
+		}
+		if test.reason == "" {
+			continue
+		}
+		// invalid addresses are skipped even when private ones are allowed
+		for _, allowPrivate = range []bool{false, true} {
+			if !shouldSkipAddr(&net.TCPAddr{IP: ip, Port: 11113}) || !shouldSkipAddr(&net.UDPAddr{IP: ip, Port: 11113}) {
+				t.Errorf("%s (allowPrivate=%v): not skipped", test.ip, allowPrivate)
+			}
+		}
+	}
+}
+
+func TestParseNetpuncherAddr(t *testing.T) {
+	for _, a := range []*NetpuncherAddr{
+		{Net: "netpuncher4", Addr: "netpuncher.example:11115", ID: 12},
+		{Net: "netpuncher6", Addr: "[2001:db8::1]:11115", ID: 1<<64 - 1},
+		// # in the address is kept
+		{Net: "netpuncher4", Addr: "a#b", ID: 0},
+	} {
+		parsed, err := ParseNetpuncherAddr(a.Net, a.String())
+		if err != nil || !parsed.Equal(a) {
+			t.Errorf("%s %s: got %+v, %v", a.Net, a, parsed, err)
+		}
+	}
+
+	for _, test := range []struct{ network, s string }{
+		{"tcp", "netpuncher.example:11115#12"},
+		{"netpuncher4", "netpuncher.example:11115"},
+		{"netpuncher4", "#12"},
+		{"netpuncher4", "netpuncher.example:11115#"},
+		{"netpuncher4", "netpuncher.example:11115#-1"},
+		{"netpuncher4", "netpuncher.example:11115#x"},
+		{"netpuncher4", "netpuncher.example:11115#18446744073709551616"},
+	} {
+		if a, err := ParseNetpuncherAddr(test.network, test.s); err == nil {
+			t.Errorf("%s %q: got %+v, want error", test.network, test.s, a)
+		}
+	}
+}
+
+func TestNetpuncherAddrEqual(t *testing.T) {
+	a := &NetpuncherAddr{Net: "netpuncher4", Addr: "netpuncher.example:11115", ID: 12}
+	tests := []struct {
+		b     *NetpuncherAddr
+		equal bool
+	}{
+		{&NetpuncherAddr{Net: "netpuncher4", Addr: "netpuncher.example:11115", ID: 12}, true},
+		{&NetpuncherAddr{Net: "netpuncher6", Addr: "netpuncher.example:11115", ID: 12}, false},
+		{&NetpuncherAddr{Net: "netpuncher4", Addr: "other.example:11115", ID: 12}, false},
+		{&NetpuncherAddr{Net: "netpuncher4", Addr: "netpuncher.example:11115", ID: 13}, false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		if eq := a.Equal(test.b); eq != test.equal {
+			t.Errorf("Equal(%+v) = %v, want %v", test.b, eq, test.equal)
+		}
+	}
+	var n *NetpuncherAddr
+	if !n.Equal(nil) {
+		t.Error("nil addresses not equal")
+	}
+}
+
+func TestDryRunChecker(t *testing.T) {
+	if _, err := dryRunChecker("maybe"); err == nil {
+		t.Error("no error for an invalid status")
+	}
+	oldChecker := defaultChecker
+	defer func() { defaultChecker = oldChecker }()
+	for _, want := range []ConnectStatus{ConnectStatusPending, ConnectStatusSuccess, ConnectStatusFailure} {
+		checker, err := dryRunChecker(want.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defaultChecker = checker
+		c := NewCache()
+		results := make(chan CheckResult, 1)
+		c.Checks = CheckSinkFunc(func(r CheckResult) {
+			select {
+			case results <- r:
+			default:
+			}
+		})
+		c.UpdateGame(LeagueGame{ID: 1})
+		// a TEST-NET address that would never answer
+		c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 11113}})
+		select {
+		case r := <-results:
+			if r.Status != want || (r.Err != nil) != (want == ConnectStatusFailure) {
+				t.Errorf("got status %v with error %v, want %v", r.Status, r.Err, want)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%v: no check recorded", want)
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// parseCORSOrigins parses a comma-separated list of origins such as
+// "https://example.com,http://localhost:3000", or "*" for any origin.
+func parseCORSOrigins(s string) []string {
+	var origins []string
+	for _, o := range strings.Split(s, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins = append(origins, o)
+		}
+	}
+	return origins
+}
+
+// originAllowlist is a parsed list of origins, see parseCORSOrigins.
+type originAllowlist struct {
+	any     bool            // "*" allows any origin
+	allowed map[string]bool // lower-case origins
+}
+
+func newOriginAllowlist(origins []string) originAllowlist {
+	l := originAllowlist{allowed: make(map[string]bool)}
+	for _, o := range origins {
+		if o == "*" {
+			l.any = true
+		}
+		l.allowed[strings.ToLower(o)] = true
+	}
+	return l
+}
+
+// allows returns whether the origin is on the list, comparing
+// case-insensitively.
+func (l originAllowlist) allows(origin string) bool {
+	return l.any || l.allowed[strings.ToLower(origin)]
+}
+
+// corsHandler allows browsers on the given origins to access the API. It sets
+// Access-Control-Allow-Origin for allowed origins and answers preflight
+// requests. Without origins, no CORS headers are sent.
+func corsHandler(origins []string) gin.HandlerFunc {
+	allowed := newOriginAllowlist(origins)
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" || !allowed.allows(origin) {
+			return
+		}
+		if allowed.any {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Header("Access-Control-Allow-Origin", origin)
+			c.Header("Vary", "Origin")
+		}
+		if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+			c.Header("Access-Control-Allow-Methods", "GET, OPTIONS")
+			// for API_TOKEN
+			c.Header("Access-Control-Allow-Headers", "Authorization")
+			c.Header("Access-Control-Max-Age", "86400")
+			c.AbortWithStatus(http.StatusNoContent)
+		}
+	}
+}
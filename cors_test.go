@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseCORSOrigins(t *testing.T) {
+	if o := parseCORSOrigins(" https://a.example, http://localhost:3000 ,"); !reflect.DeepEqual(o, []string{"https://a.example", "http://localhost:3000"}) {
+		t.Errorf("got %q", o)
+	}
+	if o := parseCORSOrigins(""); len(o) != 0 {
+		t.Errorf("got %q for empty string", o)
+	}
+}
+
+func TestCORSHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := func(origins ...string) *gin.Engine {
+		r := gin.New()
+		r.Use(corsHandler(origins))
+		r.GET("/games", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+		return r
+	}
+	tests := []struct {
+		name    string
+		r       *gin.Engine
+		method  string
+		origin  string
+		code    int
+		allowed string // Access-Control-Allow-Origin
+	}{
+		{"disabled", router(), "GET", "https://a.example", http.StatusOK, ""},
+		{"disabled preflight", router(), "OPTIONS", "https://a.example", http.StatusNotFound, ""},
+		{"allowed", router("https://a.example"), "GET", "https://a.example", http.StatusOK, "https://a.example"},
+		{"other origin", router("https://a.example"), "GET", "https://b.example", http.StatusOK, ""},
+		{"preflight", router("https://a.example"), "OPTIONS", "https://a.example", http.StatusNoContent, "https://a.example"},
+		{"any", router("*"), "GET", "https://b.example", http.StatusOK, "*"},
+		{"no origin", router("*"), "GET", "", http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/games", nil)
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+		if test.method == "OPTIONS" {
+			req.Header.Set("Access-Control-Request-Method", "GET")
+		}
+		w := httptest.NewRecorder()
+		test.r.ServeHTTP(w, req)
+		if w.Code != test.code {
+			t.Errorf("%s: status %d, want %d", test.name, w.Code, test.code)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != test.allowed {
+			t.Errorf("%s: Access-Control-Allow-Origin %q, want %q", test.name, got, test.allowed)
+		}
+		if test.code == http.StatusNoContent && w.Header().Get("Access-Control-Allow-Headers") != "Authorization" {
+			t.Errorf("%s: Authorization header not allowed", test.name)
+		}
+	}
+}
@@ -2,61 +2,171 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/Masterminds/sprig/v3"
 	"github.com/apex/log"
+	"github.com/apex/log/handlers/cli"
+	jsonlog "github.com/apex/log/handlers/json"
 	"github.com/apex/log/handlers/text"
 	"github.com/clonkspot/gocrema/eventsource"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/render"
+	"golang.org/x/time/rate"
 )
 
-// GameEventsURL is the URL to the league event stream.
+// GameEventsURL is the URL to the league event stream. It and LeagueURL are
+// used unless multiple leagues are configured with LEAGUES.
 var GameEventsURL = "https://clonkspot.org/league/game_events.php"
 
 // LeagueURL is the URL to the league server.
 var LeagueURL = "http://league.clonkspot.org:80/"
 
-func getGameAddresses(id int) ([]net.Addr, error) {
-	url := fmt.Sprintf("%s?action=query&game_id=%d", LeagueURL, id)
-	res, err := http.Get(url)
+// leagueQueryRetries is the number of times a league query is retried after a
+// transient failure.
+var leagueQueryRetries = 2
+
+// leagueQueryRetryDelay is the delay before the first retry of a league query.
+// It doubles with every retry.
+var leagueQueryRetryDelay = time.Second
+
+// leagueQueryTimeout limits the time for a single league query, including
+// reading the answer.
+var leagueQueryTimeout = 10 * time.Second
+
+// leagueQueryRate limits the league queries per second, regardless of
+// fetchConcurrency. Zero disables the limit.
+var leagueQueryRate = 5.0
+
+// fetchConcurrency is the maximum number of parallel league queries for
+// fetching game addresses.
+var fetchConcurrency = 10
+
+// eventsIdleTimeout is the time without any data on a league event stream,
+// including keep-alive comments, after which the stream is considered stalled
+// and reconnected. Zero disables the timeout.
+var eventsIdleTimeout = 5 * time.Minute
+
+// eventsMaxBackoff limits the reconnection delay of a league event stream,
+// which doubles with every failed attempt.
+var eventsMaxBackoff = eventsource.DefaultMaxBackoff
+
+// httpStatusError is returned for unsuccessful HTTP responses.
+type httpStatusError struct {
+	StatusCode int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status %d", e.StatusCode)
+}
+
+// isTransient returns whether a failed request should be retried, i.e. whether
+// it failed due to a network or server error.
+func isTransient(err error) bool {
+	if se, ok := err.(*httpStatusError); ok {
+		return se.StatusCode >= 500
+	}
+	return true
+}
+
+// LeagueClient queries the league server.
+type LeagueClient struct {
+	URL     string // base URL of the league server, see LeagueURL
+	Client  *http.Client
+	Limiter *rate.Limiter // limits queries if set
+}
+
+// NewLeagueClient creates a LeagueClient for the league server at url, limited
+// to leagueQueryRate queries per second.
+func NewLeagueClient(url string) *LeagueClient {
+	lc := &LeagueClient{URL: url, Client: &http.Client{}}
+	if leagueQueryRate > 0 {
+		lc.Limiter = rate.NewLimiter(rate.Limit(leagueQueryRate), 1)
+	}
+	return lc
+}
+
+// query fetches the league answer for the given url once, giving up after
+// leagueQueryTimeout or when ctx is done. Waiting for the Limiter doesn't count
+// toward the timeout.
+func (lc *LeagueClient) query(ctx context.Context, url string) ([]byte, error) {
+	if lc.Limiter != nil {
+		if err := lc.Limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, leagueQueryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
-	body, err := ioutil.ReadAll(res.Body)
-	res.Body.Close()
+	res, err := lc.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, &httpStatusError{StatusCode: res.StatusCode}
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// GameAddresses queries the league for the addresses of the game with the given
+// id, retrying transient failures. If ctx is done before, it returns
+// ctx.Err().
+func (lc *LeagueClient) GameAddresses(ctx context.Context, id int) ([]net.Addr, error) {
+	url := fmt.Sprintf("%s?action=query&game_id=%d", lc.URL, id)
+	body, err := lc.query(ctx, url)
+	delay := leagueQueryRetryDelay
+	for retry := 1; err != nil && ctx.Err() == nil && isTransient(err) && retry <= leagueQueryRetries; retry++ {
+		log.WithError(err).WithField("id", id).Debugf("GameAddresses: retry %d in %v", retry, delay)
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+		}
+		delay *= 2
+		body, err = lc.query(ctx, url)
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	if err != nil {
 		return nil, err
 	}
 	linere := regexp.MustCompile(`(?m)^Address=(.+)$`)
-	addressre := regexp.MustCompile(`(TCP|UDP):"?([0-9a-f:.[\]]+)"?`)
+	// IPv6 addresses may have a zone (e.g. [fe80::1%eth0]:11113)
+	addressre := regexp.MustCompile(`(TCP|UDP):"?([0-9a-f:.[\]]+(?:%[\w.-]+\]:[0-9]+)?)"?`)
 	m := linere.FindSubmatch(body)
 	if m == nil {
 		return nil, fmt.Errorf("No Address= line in league answer")
 	}
-	addrm := addressre.FindAllSubmatch(m[1], -1)
-	addrs := make([]net.Addr, len(addrm))
-	for i, addr := range addrm {
-		switch string(addr[1]) {
-		case "TCP":
-			addrs[i], err = net.ResolveTCPAddr("tcp", string(addr[2]))
-		case "UDP":
-			addrs[i], err = net.ResolveUDPAddr("udp", string(addr[2]))
-		default:
-			err = fmt.Errorf("unexpected network %s", addr[1])
-		}
+	// A single malformed address shouldn't hide the whole game, so addresses
+	// that fail to parse are skipped.
+	var addrs []net.Addr
+	for _, addr := range addressre.FindAllSubmatch(m[1], -1) {
+		a, err := parseAddr(strings.ToLower(string(addr[1])), string(addr[2]))
 		if err != nil {
-			return nil, err
+			log.WithError(err).WithFields(log.Fields{"id": id, "addr": string(addr[0])}).Debug("GameAddresses: skipping address")
+			continue
 		}
+		addrs = append(addrs, a)
 	}
 
 	// Netpuncher info
@@ -68,35 +178,273 @@ func getGameAddresses(id int) ([]net.Addr, error) {
 		npre := regexp.MustCompile(`(?m)^ +IPv([46])=([0-9]+)$`)
 		ms := npre.FindAllSubmatch(body, -1)
 		for _, m := range ms {
-			id, _ := strconv.ParseUint(string(m[2]), 10, 64)
-			addrs = append(addrs, &NetpuncherAddr{Net: "netpuncher" + string(m[1]), Addr: netpuncherAddr, ID: id})
+			npid, err := strconv.ParseUint(string(m[2]), 10, 64)
+			if err != nil {
+				log.WithError(err).WithFields(log.Fields{"id": id, "addr": string(m[0])}).Debug("GameAddresses: skipping netpuncher address")
+				continue
+			}
+			addrs = append(addrs, &NetpuncherAddr{Net: "netpuncher" + string(m[1]), Addr: netpuncherAddr, ID: npid})
 		}
 	}
 
 	return addrs, nil
 }
 
+// envDuration overrides *d with the duration in the given environment
+// variable, if set.
+func envDuration(name string, d *time.Duration) {
+	if v := os.Getenv(name); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			log.WithError(err).Fatalf("invalid %s", name)
+		}
+		*d = parsed
+	}
+}
+
+// envInt overrides *i with the integer in the given environment variable, if
+// set.
+func envInt(name string, i *int) {
+	if v := os.Getenv(name); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil {
+			log.WithError(err).Fatalf("invalid %s", name)
+		}
+		*i = parsed
+	}
+}
+
+// setupLogging sets the log handler (text, cli or json, defaulting to text)
+// and the log level (defaulting to info).
+func setupLogging(format, level string) {
+	switch format {
+	case "", "text":
+		log.SetHandler(text.Default)
+	case "cli":
+		log.SetHandler(cli.Default)
+	case "json":
+		log.SetHandler(jsonlog.Default)
+	default:
+		log.Fatalf("invalid LOG_FORMAT %q", format)
+	}
+	if level != "" {
+		l, err := log.ParseLevel(level)
+		if err != nil {
+			log.WithError(err).Fatal("invalid LOG_LEVEL")
+		}
+		log.SetLevel(l)
+	}
+}
+
+// envFloat overrides *f with the number in the given environment variable, if
+// set.
+func envFloat(name string, f *float64) {
+	if v := os.Getenv(name); v != "" {
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			log.WithError(err).Fatalf("invalid %s", name)
+		}
+		*f = parsed
+	}
+}
+
+// envBool overrides *b with the boolean in the given environment variable, if
+// set.
+func envBool(name string, b *bool) {
+	if v := os.Getenv(name); v != "" {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			log.WithError(err).Fatalf("invalid %s", name)
+		}
+		*b = parsed
+	}
+}
+
+// envHostPatterns overrides *p with the host patterns in the given environment
+// variable, if set. See parseHostPatterns.
+func envHostPatterns(name string, p *[]string) {
+	if v := os.Getenv(name); v != "" {
+		parsed, err := parseHostPatterns(v)
+		if err != nil {
+			log.WithError(err).Fatalf("invalid %s", name)
+		}
+		*p = parsed
+	}
+}
+
+// envIDRanges overrides *r with the id ranges in the given environment
+// variable, if set. See parseIDRanges.
+func envIDRanges(name string, r *[]IDRange) {
+	if v := os.Getenv(name); v != "" {
+		parsed, err := parseIDRanges(v)
+		if err != nil {
+			log.WithError(err).Fatalf("invalid %s", name)
+		}
+		*r = parsed
+	}
+}
+
 func main() {
-	log.SetHandler(text.Default)
-	//log.SetLevel(log.DebugLevel)
+	export := flag.String("export", "", "export all games as csv or json to stdout once the cache is stable after startup, then exit")
+	dryRun := flag.String("dry-run", "", "don't connect to any game, report the given status (pending, success or failure) for all addresses instead")
+	flag.Parse()
+	setupLogging(os.Getenv("LOG_FORMAT"), os.Getenv("LOG_LEVEL"))
+
+	envDuration("RECHECK_INTERVAL", &recheckInterval)
+	envFloat("RECHECK_JITTER", &recheckJitter)
+	if recheckJitter < 0 || recheckJitter >= 1 {
+		log.Fatalf("invalid RECHECK_JITTER %v, must be in [0, 1)", recheckJitter)
+	}
+	envDuration("FAILURE_BACKOFF_MIN", &failureBackoffMin)
+	envDuration("FAILURE_BACKOFF_MAX", &failureBackoffMax)
+	envDuration("PENDING_TIMEOUT", &pendingTimeout)
+	envInt("CHECK_CONCURRENCY", &checkConcurrency)
+	if checkConcurrency < 1 {
+		log.Fatalf("invalid CHECK_CONCURRENCY %d, must be at least 1", checkConcurrency)
+	}
+	envInt("GAME_UPDATES_BUFFER", &gameUpdatesBufSize)
+	if gameUpdatesBufSize < 1 {
+		log.Fatalf("invalid GAME_UPDATES_BUFFER %d, must be at least 1", gameUpdatesBufSize)
+	}
+	envInt("HISTORY_LENGTH", &historyLength)
+	envDuration("CONNECT_TIMEOUT", &connectTimeout)
+	envInt("UDP_PINGS", &udpPings)
+	envBool("ALLOW_PRIVATE", &allowPrivate)
+	envBool("RACE_ADDRS", &raceAddrs)
+	envHostPatterns("ALLOW_HOSTS", &gameFilter.AllowHosts)
+	envHostPatterns("DENY_HOSTS", &gameFilter.DenyHosts)
+	envIDRanges("ALLOW_IDS", &gameFilter.AllowIDs)
+	envIDRanges("DENY_IDS", &gameFilter.DenyIDs)
+	envDuration("DNS_CACHE_TTL", &dnsCacheTTL)
+	envDuration("DNS_NEGATIVE_TTL", &dnsNegativeTTL)
+	if v := os.Getenv("BIND_ADDRESS"); v != "" {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			log.Fatalf("invalid BIND_ADDRESS %q", v)
+		}
+		checkDialer = NewLocalDialer(ip)
+	}
+	if v := os.Getenv("PROXY"); v != "" {
+		if err := setCheckProxy(v); err != nil {
+			log.WithError(err).Fatal("invalid PROXY")
+		}
+	}
+	envInt("LEAGUE_QUERY_RETRIES", &leagueQueryRetries)
+	envDuration("LEAGUE_QUERY_TIMEOUT", &leagueQueryTimeout)
+	envFloat("LEAGUE_QUERY_RATE", &leagueQueryRate)
+	envInt("FETCH_CONCURRENCY", &fetchConcurrency)
+	envDuration("FETCH_DEBOUNCE", &fetchDebounce)
+	envDuration("EVENTS_IDLE_TIMEOUT", &eventsIdleTimeout)
+	envDuration("EVENTS_MAX_BACKOFF", &eventsMaxBackoff)
+	cacheFile = os.Getenv("CACHE_FILE")
+	envDuration("PERSIST_INTERVAL", &persistInterval)
+	envDuration("SUMMARY_INTERVAL", &summaryInterval)
+	envDuration("HEALTH_MAX_AGE", &healthMaxAge)
+	envFloat("ADDRS_MISSING_MAX_RATIO", &addrsMissingMaxRatio)
+	envDuration("ADDRS_FETCH_GRACE", &addrsFetchGrace)
+	protectGames := false
+	envBool("PROTECT_GAMES", &protectGames)
+	tlsCert, tlsKey := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY")
+	if (tlsCert == "") != (tlsKey == "") {
+		log.Fatal("TLS_CERT and TLS_KEY must be set together")
+	}
+
+	leagues := defaultLeagues()
+	if v := os.Getenv("LEAGUES"); v != "" {
+		var err error
+		if leagues, err = parseLeagues(v); err != nil {
+			log.WithError(err).Fatal("invalid LEAGUES")
+		}
+	}
+
+	if *dryRun != "" {
+		checker, err := dryRunChecker(*dryRun)
+		if err != nil {
+			log.WithError(err).Fatal("invalid -dry-run")
+		}
+		defaultChecker = checker
+		log.WithField("status", *dryRun).Warn("dry run, no connection checks are made")
+	}
+
+	if *export != "" {
+		// a one-shot export neither loads nor overwrites the cache file
+		cacheFile = ""
+		if err := runExport(*export, leagues, os.Stdout); err != nil {
+			log.WithError(err).Fatal("export failed")
+		}
+		return
+	}
 
 	cache := NewCache()
 
-	go monitorGames(cache)
+	// cancelled on shutdown, stops the league monitors and their fetches
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	r := gin.Default()
+	go logGameUpdates(cache.GameUpdates.RegisterBlocking())
+	metrics.Register("crema_checks_active", "gauge",
+		"Number of connection checks in flight.",
+		func() float64 { return float64(cache.ActiveChecks()) })
+	metrics.Register("crema_checks_queued", "gauge",
+		"Number of connection checks waiting for a free worker.",
+		func() float64 { return float64(cache.QueuedChecks()) })
+	// one snapshot per scrape keeps the counts consistent
+	addrsMetric := func(status ConnectStatus) string {
+		return fmt.Sprintf("crema_addrs{status=%q}", status)
+	}
+	var statsMetrics []MetricDesc
+	statsMetrics = append(statsMetrics, MetricDesc{"crema_games", "gauge", "Number of cached games."})
+	for _, status := range []ConnectStatus{ConnectStatusPending, ConnectStatusSuccess, ConnectStatusFailure} {
+		statsMetrics = append(statsMetrics, MetricDesc{addrsMetric(status), "gauge", "Number of cached addresses by status."})
+	}
+	metrics.RegisterCollector(statsMetrics, func() map[string]float64 {
+		s := cache.Stats()
+		return map[string]float64{
+			"crema_games":                     float64(s.Games),
+			addrsMetric(ConnectStatusPending): float64(s.AddrsPending),
+			addrsMetric(ConnectStatusSuccess): float64(s.AddrsSuccess),
+			addrsMetric(ConnectStatusFailure): float64(s.AddrsFailure),
+		}
+	})
+	metrics.Register("crema_games_addrs_missing", "gauge",
+		"Number of games whose addresses couldn't be fetched from the league.",
+		func() float64 {
+			missing, _ := cache.CountAddrsMissing(time.Now())
+			return float64(missing)
+		})
+	var healths []*Health
+	leagueHosts := make(map[string]string) // clonk:// host by league name
+	var monitors sync.WaitGroup
+	for _, l := range leagues {
+		health := NewHealth()
+		health.League = l.Name
+		healths = append(healths, health)
+		leagueHosts[l.Name] = l.clonkHost()
+		monitors.Add(1)
+		go func(l League) {
+			defer monitors.Done()
+			monitorGames(ctx, cache, health, l)
+		}(l)
+	}
+
+	// wait for pending address fetches to be aborted, then close the cache
+	// so that it gets persisted
+	go func() {
+		<-ctx.Done()
+		log.Info("shutting down")
+		monitors.Wait()
+		cache.Close()
+		os.Exit(0)
+	}()
+
+	// like gin.Default(), but without API tokens in the access log
+	r := gin.New()
+	r.Use(gin.LoggerWithFormatter(accessLogFormatter), gin.Recovery())
+	corsOrigins := parseCORSOrigins(os.Getenv("CORS_ORIGINS"))
+	r.Use(corsHandler(corsOrigins))
 	funcmap := sprig.FuncMap()
 	funcmap["OverallStatus"] = func(g CacheItem) ConnectStatus {
-		s := ConnectStatusFailure
-		for _, addr := range g.Addrs {
-			switch addr.Status {
-			case ConnectStatusSuccess:
-				return ConnectStatusSuccess
-			case ConnectStatusPending:
-				s = ConnectStatusPending
-			}
-		}
-		return s
+		return g.Reachability()
 	}
 	funcmap["StatusToString"] = func(s ConnectStatus, success, pending, failure string) (string, error) {
 		switch s {
@@ -115,20 +463,34 @@ func main() {
 	}
 	r.SetFuncMap(funcmap)
 	r.LoadHTMLGlob("templates/*")
-	tmplLeagueURL := strings.Replace(LeagueURL, "http://", "", 1)
 	r.GET("/", func(c *gin.Context) {
 		games := cache.Get()
 		c.HTML(http.StatusOK, "layout.html", gin.H{
-			"Games":     games,
-			"LeagueURL": tmplLeagueURL,
+			"Games":      games,
+			"LeagueURLs": leagueHosts,
 		})
 	})
-	renderRow := func(id int, g *CacheItem) string {
+	// API_TOKEN protects /metrics, and the game API with PROTECT_GAMES. The
+	// web interface and /healthz stay open.
+	auth := tokenAuth(os.Getenv("API_TOKEN"))
+	api := r.Group("")
+	if protectGames {
+		api.Use(auth)
+	}
+	api.GET("/games", gamesHandler(cache))
+	api.GET("/games/events", gameEventsHandler(cache))
+	api.GET("/ws", gameUpdatesWSHandler(cache, corsOrigins))
+	r.GET("/healthz", healthHandler(cache, healths...))
+	r.GET("/metrics", auth, metricsHandler(metrics))
+	r.GET("/debug/stats", auth, func(c *gin.Context) {
+		c.JSON(http.StatusOK, cache.Stats())
+	})
+	renderRow := func(id GameKey, g *CacheItem) string {
 		// this kind of sucks
 		html := r.HTMLRender.Instance("gamerow.html", gin.H{
-			"ID":        g.Game.ID,
+			"ID":        id.String(),
 			"G":         g,
-			"LeagueURL": tmplLeagueURL,
+			"LeagueURL": leagueHosts[g.Game.Source],
 		}).(render.HTML)
 
 		var output bytes.Buffer
@@ -140,93 +502,198 @@ func main() {
 	}
 	r.GET("/updates", func(c *gin.Context) {
 		c.Header("Content-Type", "text/event-stream")
-		updates := cache.GameUpdates.Register()
-		defer cache.GameUpdates.Unregister(updates)
+		games, updates := cache.Subscribe()
+		log.WithField("listeners", cache.GameUpdates.Count()).Debug("updates: client connected")
+		defer func() {
+			cache.GameUpdates.Unregister(updates)
+			log.WithField("listeners", cache.GameUpdates.Count()).Debug("updates: client disconnected")
+		}()
 
 		// init: send update event for all games and init event with existing ids
-		games := cache.Get()
-		ids := make([]int, 0, len(games))
-		for id, g := range games {
-			ids = append(ids, id)
-			c.SSEvent("update", gin.H{
-				"id":   id,
-				"html": renderRow(id, &g),
-			})
-		}
-		c.SSEvent("init", gin.H{"ids": ids})
+		sendAll := func(games map[GameKey]CacheItem) {
+			ids := make([]string, 0, len(games))
+			for id, g := range games {
+				ids = append(ids, id.String())
+				c.SSEvent("update", gin.H{
+					"id":   id.String(),
+					"html": renderRow(id, &g),
+				})
+			}
+			c.SSEvent("init", gin.H{"ids": ids})
+		}
+		sendAll(games)
 		if f, ok := c.Writer.(http.Flusher); ok {
 			f.Flush()
 		}
 
-		for update := range updates {
-			u := update.(*CacheUpdate)
-			if u.G != nil {
+		for u := range updates {
+			if u.Resync {
+				sendAll(cache.Get())
+			} else if u.G != nil {
 				c.SSEvent("update", gin.H{
-					"id":   u.ID,
-					"html": renderRow(u.ID, u.G),
+					"id":   u.Key.String(),
+					"html": renderRow(u.Key, u.G),
 				})
 			} else {
-				c.SSEvent("delete", gin.H{"id": u.ID})
+				c.SSEvent("delete", gin.H{"id": u.Key.String()})
 			}
 			if f, ok := c.Writer.(http.Flusher); ok {
 				f.Flush()
 			}
 		}
 	})
-	r.Run(os.Getenv("PORT"))
+	addr := listenAddress()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.WithError(err).WithField("addr", addr).Fatal("cannot listen")
+	}
+	log.WithFields(log.Fields{"addr": ln.Addr().String(), "tls": tlsCert != ""}).Info("listening")
+	if err := serveHTTP(ln, r, tlsCert, tlsKey); err != nil {
+		log.WithError(err).Fatal("HTTP server failed")
+	}
+}
+
+// serveHTTP serves h on ln, using HTTPS with the given certificate and key
+// files if set.
+func serveHTTP(ln net.Listener, h http.Handler, certFile, keyFile string) error {
+	server := &http.Server{Handler: h}
+	if certFile != "" {
+		return server.ServeTLS(ln, certFile, keyFile)
+	}
+	return server.Serve(ln)
 }
 
-func monitorGames(c *Cache) {
-	es := eventsource.New(GameEventsURL)
+// defaultAddress is the listen address of the HTTP server if ADDRESS is unset.
+const defaultAddress = "127.0.0.1:8080"
+
+// listenAddress returns the listen address of the HTTP server from ADDRESS,
+// falling back to the deprecated PORT and then defaultAddress.
+func listenAddress() string {
+	if addr := os.Getenv("ADDRESS"); addr != "" {
+		return addr
+	}
+	if port := os.Getenv("PORT"); port != "" {
+		log.Warn("PORT is deprecated, use ADDRESS instead")
+		return port
+	}
+	log.Warnf("ADDRESS not set, listening on %s", defaultAddress)
+	return defaultAddress
+}
+
+// monitorGames follows the event stream of the league, applying its events
+// to the cache, until ctx is done. Address fetches in flight are cancelled
+// then.
+func monitorGames(ctx context.Context, c *Cache, h *Health, l League) {
+	es := eventsource.NewWithContext(ctx, l.EventsURL,
+		eventsource.WithIdleTimeout(eventsIdleTimeout),
+		eventsource.WithBackoff(eventsMaxBackoff),
+		eventsource.WithDebugf(log.WithField("league", l.Name).Debugf))
 	defer es.Close()
+	s := c.Source(l.Name)
+	f := newAddrFetcher(ctx, s, NewLeagueClient(l.LeagueURL))
+	defer f.Close()
+	name := "crema_eventsource_reconnects_total"
+	if l.Name != "" {
+		name += fmt.Sprintf("{league=%q}", l.Name)
+	}
+	metrics.Register(name, "counter",
+		"Number of times the league event stream was reconnected after being lost.",
+		func() float64 { return float64(es.Reconnects()) })
 
+	var lost time.Time // time the event stream was lost
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case <-es.OnOpen:
-			// do nothing
+			h.SetOpen(true)
+			if !lost.IsZero() {
+				log.WithFields(log.Fields{"league": l.Name, "downtime": time.Since(lost).String()}).Info("event stream reconnected")
+				lost = time.Time{}
+			}
 		case msg := <-es.OnMessage:
-			switch msg.EventType {
-			case "init":
-				var games []LeagueGame
-				if err := json.Unmarshal([]byte(msg.Data), &games); err != nil {
-					log.WithError(err).Error("init: error parsing JSON")
-					break
-				}
-				log.Infof("init with %d games\n", len(games))
-				c.UpdateAllGames(games)
-				for _, game := range games {
-					addrs, err := getGameAddresses(game.ID)
-					if err != nil {
-						log.WithError(err).WithField("id", game.ID).Error("init: error getting addresses")
-						continue
-					}
-					c.UpdateAddrs(game.ID, addrs)
-				}
-			case "create", "update":
-				var game LeagueGame
-				if err := json.Unmarshal([]byte(msg.Data), &game); err != nil {
-					log.WithError(err).Error("create/update: error parsing JSON")
-					break
-				}
-				c.UpdateGame(game)
-				addrs, err := getGameAddresses(game.ID)
-				if err != nil {
-					log.WithError(err).WithField("id", game.ID).Error("create/update: error getting addresses")
-					break
-				}
-				c.UpdateAddrs(game.ID, addrs)
-			case "end", "delete":
-				var game LeagueGame
-				if err := json.Unmarshal([]byte(msg.Data), &game); err != nil {
-					log.WithError(err).Error("end/delete: error parsing JSON")
-					break
-				}
+			h.Updated(time.Now())
+			handleGameEvent(s, f, msg)
+		case err := <-es.OnError:
+			h.SetOpen(false)
+			if lost.IsZero() {
+				lost = time.Now()
+			}
+			log.WithError(err).WithField("league", l.Name).Warn("event stream error")
+		}
+	}
+}
+
+// handleGameEvent applies a league event to the league's games in the cache.
+// Addresses are fetched in the background, so this doesn't block on the league
+// server.
+func handleGameEvent(c *SourceCache, f *addrFetcher, msg eventsource.Message) {
+	switch msg.EventType {
+	case "init":
+		var games []LeagueGame
+		if err := json.Unmarshal([]byte(msg.Data), &games); err != nil {
+			log.WithError(err).Error("init: error parsing JSON")
+			break
+		}
+		// drop filtered games in place
+		allowed := games[:0]
+		for _, game := range games {
+			if gameFilter.Allowed(&game) {
+				allowed = append(allowed, game)
+			}
+		}
+		log.WithField("league", c.Source).Infof("init with %d games, %d filtered", len(allowed), len(games)-len(allowed))
+		games = allowed
+		c.UpdateAllGames(games)
+		for _, game := range games {
+			updateAddrs(c, f, &game)
+		}
+	case "create", "update":
+		var game LeagueGame
+		if err := json.Unmarshal([]byte(msg.Data), &game); err != nil {
+			log.WithError(err).Error("create/update: error parsing JSON")
+			break
+		}
+		if !gameFilter.Allowed(&game) {
+			// the game may have been allowed before an update, with
+			// its addresses still being fetched
+			f.Cancel(game.ID)
+			if _, ok := c.GetGame(game.ID); ok {
 				c.DeleteGame(game.ID)
-			default:
-				fmt.Println(msg.EventType, msg.Data)
 			}
-		case err := <-es.OnError:
-			fmt.Printf("err: %v\n", err)
+			break
+		}
+		old, cached := c.GetGame(game.ID)
+		c.UpdateGame(game)
+		if game.Addresses == nil && cached && old.AddrsFetched && !game.addrsChanged(&old.Game) {
+			// metadata-only update, keep the known addresses
+			break
+		}
+		updateAddrs(c, f, &game)
+	case "end", "delete":
+		var game LeagueGame
+		if err := json.Unmarshal([]byte(msg.Data), &game); err != nil {
+			log.WithError(err).Error("end/delete: error parsing JSON")
+			break
 		}
+		// the game might be deleted right after its creation
+		f.Cancel(game.ID)
+		if _, ok := c.GetGame(game.ID); !ok {
+			// filtered or unknown, nothing to delete
+			break
+		}
+		c.DeleteGame(game.ID)
+	default:
+		log.WithFields(log.Fields{"type": msg.EventType, "data": msg.Data}).Info("unknown event")
+	}
+}
+
+// updateAddrs updates the addresses of the game from the event if it includes
+// them, and fetches them from the league otherwise.
+func updateAddrs(c *SourceCache, f *addrFetcher, game *LeagueGame) {
+	if game.Addresses == nil {
+		f.Fetch(game.ID)
+		return
 	}
+	c.UpdateAddrs(game.ID, game.ParseAddresses())
 }
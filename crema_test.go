@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// leagueServer starts a test league server using the given handler and returns
+// an unlimited client for it.
+func leagueServer(t *testing.T, handler http.HandlerFunc) (*LeagueClient, func()) {
+	server := httptest.NewServer(handler)
+	oldDelay := leagueQueryRetryDelay
+	leagueQueryRetryDelay = time.Millisecond
+	return &LeagueClient{URL: server.URL + "/", Client: server.Client()}, func() {
+		server.Close()
+		leagueQueryRetryDelay = oldDelay
+	}
+}
+
+func TestGetGameAddressesRetry(t *testing.T) {
+	requests := make(chan struct{}, 10)
+	lc, cleanup := leagueServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		if len(requests) <= 2 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "[Reference]\nAddress=TCP:1.2.3.4:11113\n")
+	})
+	defer cleanup()
+
+	addrs, err := lc.GameAddresses(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].String() != "1.2.3.4:11113" {
+		t.Errorf("unexpected addresses %v", addrs)
+	}
+	if n := len(requests); n != 3 {
+		t.Errorf("got %d requests, want 3", n)
+	}
+}
+
+func TestGetGameAddressesNoRetry(t *testing.T) {
+	requests := make(chan struct{}, 10)
+	lc, cleanup := leagueServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		if r.URL.Query().Get("game_id") == "404" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "[Reference]\n")
+	})
+	defer cleanup()
+
+	if _, err := lc.GameAddresses(context.Background(), 404); err == nil {
+		t.Error("expected error for 404")
+	}
+	if _, err := lc.GameAddresses(context.Background(), 1); err == nil {
+		t.Error("expected error for missing Address= line")
+	}
+	if n := len(requests); n != 2 {
+		t.Errorf("got %d requests, want 2", n)
+	}
+}
+
+func TestGetGameAddressesCancel(t *testing.T) {
+	lc, cleanup := leagueServer(t, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := lc.GameAddresses(ctx, 1); err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("cancelling took %v", d)
+	}
+
+	// also while waiting for the rate limiter
+	lc.Limiter = rate.NewLimiter(0.001, 1)
+	lc.Limiter.Wait(context.Background())
+	if _, err := lc.GameAddresses(ctx, 1); err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestGetGameAddressesTimeout(t *testing.T) {
+	release := make(chan struct{})
+	lc, cleanup := leagueServer(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	defer cleanup()
+	defer close(release)
+	oldTimeout, oldRetries := leagueQueryTimeout, leagueQueryRetries
+	leagueQueryTimeout, leagueQueryRetries = 50*time.Millisecond, 0
+	defer func() { leagueQueryTimeout, leagueQueryRetries = oldTimeout, oldRetries }()
+
+	start := time.Now()
+	if _, err := lc.GameAddresses(context.Background(), 1); err == nil {
+		t.Error("expected timeout error")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("GameAddresses returned after %v", d)
+	}
+}
+
+func TestGetGameAddressesZone(t *testing.T) {
+	lc, cleanup := leagueServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "[Reference]\nAddress=TCP:\"[fe80::1%eth0]:11113\",TCP:\"1.2.3.4:11113\"\n")
+	})
+	defer cleanup()
+
+	addrs, err := lc.GameAddresses(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 {
+		t.Fatalf("unexpected addresses %v", addrs)
+	}
+	zoned, ok := addrs[0].(*net.TCPAddr)
+	if !ok || zoned.Zone != "eth0" || !zoned.IP.Equal(net.ParseIP("fe80::1")) {
+		t.Errorf("got %#v, want fe80::1%%eth0", addrs[0])
+	}
+	if !shouldSkipAddr(addrs[0]) {
+		t.Error("zoned link-local address not skipped")
+	}
+	if addrs[1].String() != "1.2.3.4:11113" {
+		t.Errorf("got %v, want 1.2.3.4:11113", addrs[1])
+	}
+}
+
+func TestGetGameAddressesMalformed(t *testing.T) {
+	lc, cleanup := leagueServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "[Reference]\nAddress=TCP:\"1.2.3.4:99999\",UDP:\"1.2.3.4:11113\"\n")
+	})
+	defer cleanup()
+
+	addrs, err := lc.GameAddresses(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].Network() != "udp" || addrs[0].String() != "1.2.3.4:11113" {
+		t.Errorf("got %v, want only udp 1.2.3.4:11113", addrs)
+	}
+}
+
+func TestGameAddresses(t *testing.T) {
+	lc, cleanup := leagueServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `[Reference]
+Address=TCP:"1.2.3.4:11113",UDP:"[2001:db8::1]:11114"
+NetpuncherAddr="netpuncher.example:11115"
+[NetpuncherID]
+  IPv4=12
+  IPv6=34
+`)
+	})
+	defer cleanup()
+
+	addrs, err := lc.GameAddresses(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, a := range addrs {
+		got = append(got, a.Network()+" "+a.String())
+	}
+	want := []string{
+		"tcp 1.2.3.4:11113",
+		"udp [2001:db8::1]:11114",
+		"netpuncher4 netpuncher.example:11115#12",
+		"netpuncher6 netpuncher.example:11115#34",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	tests := []struct {
+		address, port, want string
+	}{
+		{"", "", defaultAddress},
+		{"", ":1234", ":1234"},
+		{"0.0.0.0:80", ":1234", "0.0.0.0:80"},
+	}
+	for _, test := range tests {
+		t.Setenv("ADDRESS", test.address)
+		t.Setenv("PORT", test.port)
+		if addr := listenAddress(); addr != test.want {
+			t.Errorf("ADDRESS=%q PORT=%q: got %q, want %q", test.address, test.port, addr, test.want)
+		}
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key to
+// dir.
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func TestServeHTTPTLS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveHTTP(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}), certFile, keyFile)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	res, err := client.Get("https://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if body, _ := io.ReadAll(res.Body); res.TLS == nil || string(body) != "ok" {
+		t.Errorf("unexpected response %q (TLS %v)", body, res.TLS != nil)
+	}
+
+	// a missing certificate is an error
+	ln2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln2.Close()
+	if err := serveHTTP(ln2, http.NotFoundHandler(), certFile+".missing", keyFile); err == nil {
+		t.Error("no error for missing certificate")
+	}
+}
+
+// fakeLeague is an in-process league. Its event stream sends events once per
+// connection and then stays open, and league.php answers address queries from
+// addrs by game id. The returned function shuts the league down.
+func fakeLeague(t *testing.T, events string, addrs map[string]string) (League, func()) {
+	done := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/game_events.php", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, events)
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	})
+	mux.HandleFunc("/league.php", func(w http.ResponseWriter, r *http.Request) {
+		a, ok := addrs[r.URL.Query().Get("game_id")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, a)
+	})
+	server := httptest.NewServer(mux)
+	l := League{EventsURL: server.URL + "/game_events.php", LeagueURL: server.URL + "/league.php"}
+	return l, func() {
+		close(done)
+		server.Close()
+	}
+}
+
+// cacheState describes the games in the cache as "id title addr=status ...",
+// sorted by id and address.
+func cacheState(c *Cache) string {
+	var games []string
+	for _, g := range c.Get() {
+		s := fmt.Sprintf("%d %s", g.Game.ID, g.Game.Title)
+		var addrs []string
+		for _, a := range g.Addrs {
+			addrs = append(addrs, fmt.Sprintf("%s:%s=%s", a.Addr.Network(), a.Addr, a.Status))
+		}
+		sort.Strings(addrs)
+		games = append(games, strings.Join(append([]string{s}, addrs...), " "))
+	}
+	sort.Strings(games)
+	return strings.Join(games, "; ")
+}
+
+func TestMonitorGames(t *testing.T) {
+	oldDebounce := fetchDebounce
+	fetchDebounce = 0
+	defer func() { fetchDebounce = oldDebounce }()
+	events := `event: init
+data: [{"id": 1, "title": "first", "host": "a", "status": "lobby"},
+data:  {"id": 2, "title": "second", "host": "b", "status": "lobby", "addresses": ["TCP:1.2.3.5:11113"]}]
+
+event: create
+data: {"id": 3, "title": "third", "host": "c", "status": "lobby"}
+
+event: update
+data: {"id": 1, "title": "renamed", "host": "a", "status": "running"}
+
+event: delete
+data: {"id": 2}
+
+`
+	l, cleanup := fakeLeague(t, events, map[string]string{
+		"1": "[Reference]\nAddress=TCP:1.2.3.4:11113,UDP:1.2.3.4:11114\n",
+		"3": "[Reference]\nAddress=TCP:1.2.3.6:11113\n",
+	})
+	defer cleanup()
+
+	c := NewCache()
+	defer c.Close()
+	// only TCP connections to the first game succeed
+	c.Checker = func(ctx context.Context, addr net.Addr) (ConnectStatus, time.Duration, error) {
+		if addr.String() == "1.2.3.4:11113" {
+			return ConnectStatusSuccess, time.Millisecond, nil
+		}
+		return ConnectStatusFailure, time.Millisecond, errors.New("refused")
+	}
+	h := NewHealth()
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		monitorGames(ctx, c, h, l)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	want := "1 renamed tcp:1.2.3.4:11113=success udp:1.2.3.4:11114=failure; 3 third tcp:1.2.3.6:11113=failure"
+	var got string
+	for i := 0; ; i++ {
+		if got = cacheState(c); got == want {
+			break
+		}
+		if i == 5000 {
+			t.Fatalf("got cache state\n%s\nwant\n%s", got, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := h.Check(time.Now()); err != nil {
+		t.Errorf("unhealthy after the events: %v", err)
+	}
+}
+
+func TestMonitorGamesCancelsFetches(t *testing.T) {
+	oldDebounce := fetchDebounce
+	fetchDebounce = 0
+	defer func() { fetchDebounce = oldDebounce }()
+	started := make(chan struct{}, 1)
+	aborted := make(chan struct{}, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/game_events.php", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "event: create\ndata: {\"id\": 1}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	// the address query hangs until it's aborted
+	mux.HandleFunc("/league.php", func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-r.Context().Done()
+		aborted <- struct{}{}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	l := League{EventsURL: server.URL + "/game_events.php", LeagueURL: server.URL + "/league.php"}
+
+	c := NewCache()
+	defer c.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		monitorGames(ctx, c, NewHealth(), l)
+		close(stopped)
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("addresses not fetched")
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("monitorGames didn't return after cancelling")
+	}
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("address query wasn't aborted")
+	}
+}
+
+func TestLeagueQueryRate(t *testing.T) {
+	oldRate := leagueQueryRate
+	leagueQueryRate = 100
+	defer func() { leagueQueryRate = oldRate }()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "[Reference]\nAddress=TCP:1.2.3.4:11113\n")
+	}))
+	defer server.Close()
+
+	lc := NewLeagueClient(server.URL + "/")
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		if _, err := lc.GameAddresses(context.Background(), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first query is free, the other 10 take 10ms each
+	if d := time.Since(start); d < 90*time.Millisecond || d > time.Second {
+		t.Errorf("11 queries took %v, want about 100ms", d)
+	}
+}
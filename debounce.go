@@ -0,0 +1,81 @@
+package main
+
+import "time"
+
+// Debounced is a Notifier subscription that collapses bursts of events into a
+// single notification, for consumers that only need to know that something
+// changed, e.g. to re-render everything.
+type Debounced[T any] struct {
+	// C receives a notification once no event was received for the quiet
+	// period. It is closed after the Notifier or the Debounced is closed.
+	C <-chan struct{}
+
+	n       *Notifier[T]
+	in      <-chan T
+	quit    chan struct{} // closed by Close
+	stopped chan struct{} // closed once run has exited
+}
+
+// RegisterDebounced registers a Debounced that notifies after quiet has passed
+// since the last event. As the events are read continuously, the subscription
+// is never dropped, no matter how many events arrive in a burst.
+func (n *Notifier[T]) RegisterDebounced(quiet time.Duration) *Debounced[T] {
+	c := make(chan struct{}, 1)
+	d := &Debounced[T]{
+		C:       c,
+		n:       n,
+		in:      n.RegisterBlocking(),
+		quit:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go d.run(c, quiet)
+	return d
+}
+
+// Close unregisters from the Notifier and closes C.
+func (d *Debounced[T]) Close() {
+	d.n.Unregister(d.in)
+	close(d.quit)
+	<-d.stopped
+}
+
+func (d *Debounced[T]) run(c chan struct{}, quiet time.Duration) {
+	defer close(d.stopped)
+	defer close(c)
+	notify := func() {
+		select {
+		case c <- struct{}{}:
+		default:
+			// the previous notification is still pending
+		}
+	}
+
+	timer := time.NewTimer(quiet)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	defer timer.Stop()
+	pending := false
+	for {
+		select {
+		case _, ok := <-d.in:
+			if !ok {
+				// deliver the last burst before closing
+				if pending {
+					notify()
+				}
+				return
+			}
+			if pending && !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(quiet)
+			pending = true
+		case <-timer.C:
+			pending = false
+			notify()
+		case <-d.quit:
+			return
+		}
+	}
+}
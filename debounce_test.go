@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDebounced(t *testing.T) {
+	n := NewNotifier[int]()
+	d := n.RegisterDebounced(20 * time.Millisecond)
+	defer d.Close()
+
+	// more events than the default buffer
+	for i := 0; i < 1000; i++ {
+		n.Notify(i)
+	}
+	select {
+	case <-d.C:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification after burst")
+	}
+	select {
+	case <-d.C:
+		t.Error("second notification for a single burst")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	n.Notify(1000)
+	select {
+	case _, ok := <-d.C:
+		if !ok {
+			t.Error("channel closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification after second event")
+	}
+}
+
+func TestDebouncedClose(t *testing.T) {
+	n := NewNotifier[int]()
+	d := n.RegisterDebounced(time.Hour)
+	if n.Count() != 1 {
+		t.Errorf("%d listeners, want 1", n.Count())
+	}
+	d.Close()
+	if _, ok := <-d.C; ok {
+		t.Error("notification after Close")
+	}
+	if n.Count() != 0 {
+		t.Errorf("%d listeners after Close", n.Count())
+	}
+
+	// closing the Notifier delivers a pending notification
+	d = n.RegisterDebounced(time.Hour)
+	n.Notify(1)
+	n.Close()
+	if _, ok := <-d.C; !ok {
+		t.Error("pending notification lost on Close")
+	}
+	if _, ok := <-d.C; ok {
+		t.Error("channel not closed after Notifier was closed")
+	}
+}
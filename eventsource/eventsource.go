@@ -6,11 +6,16 @@ package eventsource
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"mime"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,6 +32,26 @@ const (
 // DefaultRetry is the default reconnection time in milliseconds. May be overwritten by the server.
 const DefaultRetry = 3000
 
+// ErrIdleTimeout is sent on OnError if no data was received within the idle
+// timeout, see WithIdleTimeout.
+var ErrIdleTimeout = errors.New("eventsource: idle timeout")
+
+// ErrTooManyRetries is sent on OnError before the client closes itself after
+// too many consecutive failed connection attempts, see WithMaxRetries.
+var ErrTooManyRetries = errors.New("eventsource: too many failed connection attempts")
+
+// DefaultMaxBackoff is a reasonable maximum reconnection time for WithBackoff.
+const DefaultMaxBackoff = time.Minute
+
+// StableTime is the time a connection has to stay open for the client to
+// reconnect right away once it is lost. Connections lost earlier are
+// re-established after the reconnection time, so that a server closing every
+// connection immediately isn't flooded with requests.
+const StableTime = 10 * time.Second
+
+// DefaultMaxLineSize is the default maximum length of a single line in bytes.
+const DefaultMaxLineSize = 16 * 1024 * 1024
+
 // EventSource roughly implements the HTML EventSource interface.
 type EventSource struct {
 	// URL is the url the client is connecting to.
@@ -38,82 +63,302 @@ type EventSource struct {
 	OnMessage chan Message
 	OnError   chan error
 
-	onClose chan bool
+	maxLineSize  int                                      // see WithMaxLineSize
+	idleTimeout  time.Duration                            // see WithIdleTimeout
+	headers      http.Header                              // see WithHeaders
+	backoff      bool                                     // see WithBackoff
+	maxBackoff   time.Duration                            // see WithBackoff
+	maxRetries   int                                      // see WithMaxRetries
+	contentTypes []string                                 // see WithContentTypes
+	onComment    chan string                              // see WithComments
+	debugf       func(format string, args ...interface{}) // see WithDebugf
+
+	client  *http.Client
+	after   func(time.Duration) <-chan time.Time // time.After, replaceable in tests
+	stable  time.Duration                        // StableTime, replaceable in tests
+	ctx     context.Context                      // cancelled by Close or the parent context
+	cancel  context.CancelFunc                   // cancels ctx
+	stopped chan struct{}                        // closed when receive has returned
+
+	reconnects int64 // accessed atomically
 }
 
-// New creates an EventSource client.
-func New(url string) *EventSource {
-	es := &EventSource{
-		URL:        url,
-		ReadyState: CONNECTING,
-		OnOpen:     make(chan bool),
-		OnMessage:  make(chan Message),
-		OnError:    make(chan error),
-		onClose:    make(chan bool),
+// Option configures an EventSource. Options are applied by the constructors
+// before the client connects.
+type Option func(*EventSource)
+
+// WithMaxLineSize sets the maximum length of a single line in bytes. Longer
+// lines cause an error and a reconnect. The default is DefaultMaxLineSize.
+func WithMaxLineSize(n int) Option {
+	return func(es *EventSource) { es.maxLineSize = n }
+}
+
+// WithIdleTimeout sets the maximum time without receiving any data (including
+// comments) before the connection is considered dead and re-established. Zero,
+// the default, disables the timeout.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(es *EventSource) { es.idleTimeout = d }
+}
+
+// WithHeaders adds the given headers to every request, overriding the default
+// headers.
+func WithHeaders(h http.Header) Option {
+	return func(es *EventSource) { es.headers = h.Clone() }
+}
+
+// WithBackoff enables exponential backoff with jitter for consecutive failed
+// connection attempts, starting at the reconnection time and growing up to
+// max. A max of zero or less means no limit.
+func WithBackoff(max time.Duration) Option {
+	return func(es *EventSource) {
+		es.backoff = true
+		es.maxBackoff = max
 	}
+}
+
+// WithMaxRetries sets the number of consecutive failed connection attempts
+// after which the client gives up and closes itself. Zero, the default, means
+// infinite.
+func WithMaxRetries(n int) Option {
+	return func(es *EventSource) { es.maxRetries = n }
+}
+
+// WithContentTypes sets the accepted media types of responses, compared
+// case-insensitively and ignoring parameters such as charset. By default, only
+// text/event-stream is accepted.
+func WithContentTypes(types ...string) Option {
+	return func(es *EventSource) { es.contentTypes = types }
+}
+
+// WithComments sends comment lines (without the leading colon) on ch. Comments
+// are often used as keep-alive messages and never trigger an event dispatch.
+// The channel is not closed by Close.
+func WithComments(ch chan string) Option {
+	return func(es *EventSource) { es.onComment = ch }
+}
 
+// WithDebugf sets a function receiving debug messages, such as partial events
+// being discarded when a connection is lost.
+func WithDebugf(f func(format string, args ...interface{})) Option {
+	return func(es *EventSource) { es.debugf = f }
+}
+
+// New creates an EventSource client.
+func New(url string, opts ...Option) *EventSource {
+	return NewWithClient(url, &http.Client{}, opts...)
+}
+
+// NewWithClient creates an EventSource client that uses the given HTTP client
+// for its requests.
+func NewWithClient(url string, client *http.Client, opts ...Option) *EventSource {
+	es := newEventSource(context.Background(), url, opts...)
+	es.client = client
 	go es.receive()
 	return es
 }
 
-// receive connects to the url and receives messages.
+// NewWithContext creates an EventSource client that is closed when ctx is
+// cancelled, including any in-flight request.
+func NewWithContext(ctx context.Context, url string, opts ...Option) *EventSource {
+	es := newEventSource(ctx, url, opts...)
+	go es.receive()
+	return es
+}
+
+// newEventSource creates an EventSource client without connecting.
+func newEventSource(ctx context.Context, url string, opts ...Option) *EventSource {
+	ctx, cancel := context.WithCancel(ctx)
+	es := &EventSource{
+		URL:         url,
+		ReadyState:  CONNECTING,
+		maxLineSize: DefaultMaxLineSize,
+		client:      &http.Client{},
+		after:       time.After,
+		stable:      StableTime,
+		OnOpen:      make(chan bool),
+		OnMessage:   make(chan Message),
+		OnError:     make(chan error),
+		ctx:         ctx,
+		cancel:      cancel,
+		stopped:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(es)
+	}
+	return es
+}
+
+// acceptsContentType returns whether the Content-Type header value ct is one
+// of the accepted content types.
+func (es *EventSource) acceptsContentType(ct string) bool {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	accepted := es.contentTypes
+	if len(accepted) == 0 {
+		accepted = []string{"text/event-stream"}
+	}
+	for _, a := range accepted {
+		if strings.EqualFold(mt, a) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendError sends err on OnError, returning false if the client was closed
+// instead.
+func (es *EventSource) sendError(err error) bool {
+	select {
+	case es.OnError <- err:
+		return true
+	case <-es.ctx.Done():
+		return false
+	}
+}
+
+// receive connects to the url and receives messages. When the client is
+// closed, it closes the channels before returning.
 func (es *EventSource) receive() {
-	client := &http.Client{}
+	defer func() {
+		es.ReadyState = CLOSED
+		close(es.OnOpen)
+		close(es.OnMessage)
+		close(es.OnError)
+		close(es.stopped)
+	}()
 	lastEventID := ""
-	retry := time.Duration(DefaultRetry)
-	timeout := false
-	bodyEOF := make(chan bool)
-	defer close(bodyEOF)
+	retry := DefaultRetry * time.Millisecond
+	failures := 0
+	// The first attempt and the first retry after a failure are made right
+	// away, as are reconnects after losing a stable connection. The
+	// reconnection time only applies to further attempts.
+	quick := 2
+
+	// fail reports a failed connection attempt, returning false if the
+	// client should stop.
+	fail := func(err error) bool {
+		failures++
+		if !es.sendError(err) {
+			return false
+		}
+		if es.maxRetries > 0 && failures >= es.maxRetries {
+			es.sendError(ErrTooManyRetries)
+			return false
+		}
+		return true
+	}
 
 	for {
 		es.ReadyState = CONNECTING
-		if timeout {
+		if quick > 0 {
+			quick--
+		} else {
 			select {
-			case <-es.onClose:
+			case <-es.ctx.Done():
 				return
-			case <-time.After(time.Duration(retry) * time.Millisecond):
+			case <-es.after(es.retryDelay(retry, failures)):
 			}
 		}
-		timeout = true
-		req, err := http.NewRequest("GET", es.URL, nil)
+		req, err := http.NewRequestWithContext(es.ctx, "GET", es.URL, nil)
 		if err != nil {
-			es.OnError <- err
+			if !fail(err) {
+				return
+			}
 			continue
 		}
 		if lastEventID != "" {
 			req.Header.Add("Last-Event-ID", lastEventID)
 		}
 		req.Header.Add("Accept", "text/event-stream")
-		res, err := client.Do(req)
+		for k, vs := range es.headers {
+			req.Header.Del(k)
+			for _, v := range vs {
+				req.Header.Add(k, v)
+			}
+		}
+		res, err := es.client.Do(req)
 		if err != nil {
-			es.OnError <- err
+			if !fail(err) {
+				return
+			}
 			continue
 		}
-		if ct, _, err := mime.ParseMediaType(res.Header.Get("Content-Type")); err != nil || ct != "text/event-stream" {
-			es.OnError <- fmt.Errorf("The sever returned an invalid Content-Type: %s", ct)
+		if ct := res.Header.Get("Content-Type"); !es.acceptsContentType(ct) {
+			res.Body.Close()
+			if !fail(fmt.Errorf("The server returned an invalid Content-Type: %s", ct)) {
+				return
+			}
 			continue
 		}
+		failures = 0
+		quick = 0
+		opened := time.Now()
 		es.ReadyState = OPEN
-		es.OnOpen <- true
+		select {
+		case es.OnOpen <- true:
+		case <-es.ctx.Done():
+			res.Body.Close()
+			return
+		}
 
 		// Read the body.
+		bodyEOF := make(chan struct{})
 		go func() {
+			defer close(bodyEOF)
 			scanner := bufio.NewScanner(res.Body)
+			scanner.Split(newLineSplitter())
+			scanner.Buffer(nil, es.maxLineSize)
 			data := ""
 			eventType := ""
+			idBuffer := lastEventID
+			firstLine := true
+
+			// The watchdog closes the body if the connection stalls, which
+			// makes the scanner return.
+			idleTimeout := es.idleTimeout
+			idleExpired := make(chan struct{})
+			var watchdog *time.Timer
+			if idleTimeout > 0 {
+				watchdog = time.AfterFunc(idleTimeout, func() {
+					close(idleExpired)
+					res.Body.Close()
+				})
+				defer watchdog.Stop()
+			}
+
 			for scanner.Scan() {
+				if watchdog != nil {
+					watchdog.Reset(idleTimeout)
+				}
 				line := scanner.Text()
+				if firstLine {
+					// ignore a leading byte order mark
+					line = strings.TrimPrefix(line, "\ufeff")
+					firstLine = false
+				}
 				if line == "" {
-					// dispatch event
+					// dispatch event; the id is only committed with an
+					// event, so blocks without data don't change the id
+					// sent on reconnect
 					if data != "" {
-						es.OnMessage <- Message{
+						lastEventID = idBuffer
+						select {
+						case es.OnMessage <- Message{
 							EventType:   eventType,
 							Data:        strings.TrimSuffix(data, "\n"),
 							LastEventID: lastEventID,
+						}:
+						case <-es.ctx.Done():
+							return
 						}
 					}
+					// reset the buffers even if nothing was dispatched
 					data = ""
 					eventType = ""
+					idBuffer = lastEventID
+					continue
 				}
 				parts := strings.SplitN(line, ":", 2)
 				value := ""
@@ -122,7 +367,14 @@ func (es *EventSource) receive() {
 				}
 				switch parts[0] {
 				case "":
-					// line starts with colon -> ignore
+					// line starts with colon -> comment
+					if es.onComment != nil {
+						select {
+						case es.onComment <- value:
+						case <-es.ctx.Done():
+							return
+						}
+					}
 					continue
 				case "event":
 					eventType = value
@@ -130,39 +382,104 @@ func (es *EventSource) receive() {
 					data += value
 					data += "\n"
 				case "id":
-					lastEventID = value
+					// ids containing NULL are ignored as per spec
+					if !strings.ContainsRune(value, 0) {
+						idBuffer = value
+					}
 				case "retry":
+					// the value is in milliseconds; ignore anything that
+					// isn't a number
 					if r, err := strconv.ParseUint(value, 10, 32); err == nil {
-						retry = time.Duration(r)
+						retry = time.Duration(r) * time.Millisecond
 					}
 				default:
 					// ignore field
 				}
 			}
-			if err := scanner.Err(); err != nil {
-				es.OnError <- err
+			// an event without the terminating blank line is discarded
+			// as per spec
+			if (data != "" || eventType != "") && es.debugf != nil && es.ctx.Err() == nil {
+				es.debugf("eventsource: discarding partial event (type %q, %d bytes of data) from %s", eventType, len(data), es.URL)
+			}
+			select {
+			case <-idleExpired:
+				es.sendError(ErrIdleTimeout)
+			default:
+				if err := scanner.Err(); err != nil && es.ctx.Err() == nil {
+					es.sendError(err)
+				}
 			}
-			bodyEOF <- true
 		}()
 
 		select {
-		case <-es.onClose:
+		case <-es.ctx.Done():
+			// wait for the body goroutine so that it can't send on a
+			// closed channel
 			res.Body.Close()
+			<-bodyEOF
 			return
 		case <-bodyEOF:
 			res.Body.Close()
 		}
+		if time.Since(opened) >= es.stable {
+			quick = 1
+		}
+		atomic.AddInt64(&es.reconnects, 1)
+	}
+}
+
+// Reconnects returns the number of times the client reconnected after an
+// established connection was lost.
+func (es *EventSource) Reconnects() int64 {
+	return atomic.LoadInt64(&es.reconnects)
+}
+
+// retryDelay returns the time to wait before reconnecting after the given
+// number of consecutive failures.
+func (es *EventSource) retryDelay(retry time.Duration, failures int) time.Duration {
+	if !es.backoff || failures == 0 {
+		return retry
+	}
+	d := retry
+	for i := 1; i < failures && (es.maxBackoff <= 0 || d < es.maxBackoff); i++ {
+		d *= 2
+	}
+	if es.maxBackoff > 0 && d > es.maxBackoff {
+		d = es.maxBackoff
+	}
+	// jitter: wait somewhere between half and the full delay
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// newLineSplitter returns a bufio.SplitFunc that splits lines terminated by
+// CRLF, a single CR, or a single LF, as required by the spec.
+func newLineSplitter() bufio.SplitFunc {
+	// skipLF is set after a CR so that a following LF isn't treated as an
+	// additional line. This avoids waiting for the next byte after a CR.
+	skipLF := false
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		start := 0
+		if skipLF && len(data) > 0 && data[0] == '\n' {
+			start = 1
+		}
+		if i := bytes.IndexAny(data[start:], "\r\n"); i >= 0 {
+			skipLF = data[start+i] == '\r'
+			return start + i + 1, data[start : start+i], nil
+		}
+		if atEOF && len(data) > start {
+			skipLF = false
+			return len(data), data[start:], nil
+		}
+		// request more data
+		return 0, nil, nil
 	}
 }
 
-// Close closes the client.
+// Close closes the client and waits until the channels are closed. It is safe
+// to call during an active stream. Subsequent calls do nothing.
 func (es *EventSource) Close() {
-	es.onClose <- true
-	es.ReadyState = CLOSED
-	close(es.OnOpen)
-	close(es.OnMessage)
-	close(es.OnError)
-	close(es.onClose)
+	es.cancel()
+	<-es.stopped
 }
 
 // Message is an SSE event.
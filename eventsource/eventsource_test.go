@@ -1,8 +1,14 @@
 package eventsource
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -13,16 +19,39 @@ func flush(w http.ResponseWriter) {
 	}
 }
 
-func TestSimple(t *testing.T) {
-	handler := http.NewServeMux()
+// collect serves body to an EventSource client and returns the first n
+// messages it receives.
+func collect(t *testing.T, body string, n int) []Message {
+	return collectWith(t, body, n)
+}
 
-	addr := "localhost:63121"
-	server := &http.Server{
-		Addr:    addr,
-		Handler: handler,
+// collectWith is like collect, but creates the client with the given options.
+func collectWith(t *testing.T, body string, n int, opts ...Option) []Message {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "text/event-stream")
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+
+	es := New(server.URL, opts...)
+	defer es.Close()
+	var msgs []Message
+	for len(msgs) < n {
+		select {
+		case <-es.OnOpen:
+		case msg := <-es.OnMessage:
+			msgs = append(msgs, msg)
+		case err := <-es.OnError:
+			t.Fatal(err)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout after receiving %d of %d messages", len(msgs), n)
+		}
 	}
+	return msgs
+}
 
-	handler.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+func TestSimple(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Content-Type", "text/event-stream")
 		switch r.Header.Get("Last-Event-ID") {
 		case "":
@@ -39,12 +68,10 @@ func TestSimple(t *testing.T) {
 			io.WriteString(w, "retry: 10000\n")
 			io.WriteString(w, "\n")
 		}
-	})
-
-	go server.ListenAndServe()
+	}))
 	defer server.Close()
 
-	es := New("http://" + addr)
+	es := New(server.URL)
 
 	state := 0
 loop:
@@ -102,3 +129,590 @@ loop:
 		t.Errorf("unexpected ReadyState %d (should be CLOSED %d)", es.ReadyState, CLOSED)
 	}
 }
+
+func TestCloseDuringStream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "text/event-stream")
+		for i := 0; ; i++ {
+			if _, err := fmt.Fprintf(w, "data: %d\n\n", i); err != nil {
+				return
+			}
+			flush(w)
+			select {
+			case <-r.Context().Done():
+				return
+			default:
+			}
+		}
+	}))
+	defer server.Close()
+
+	for i := 0; i < 50; i++ {
+		es := New(server.URL)
+		// alternate between closing right away, after opening, and during
+		// the stream
+		if i%3 > 0 {
+			<-es.OnOpen
+		}
+		if i%3 > 1 {
+			<-es.OnMessage
+		}
+		es.Close()
+		if _, ok := <-es.OnMessage; ok {
+			t.Fatal("OnMessage not closed after Close")
+		}
+		es.Close()
+	}
+}
+
+func TestConsecutiveBlankLines(t *testing.T) {
+	msgs := collect(t, "data: a\n\n\n\ndata: b\n\n", 2)
+	if msgs[0].Data != "a" || msgs[1].Data != "b" {
+		t.Errorf("unexpected messages: %+v", msgs)
+	}
+}
+
+func TestLineEndings(t *testing.T) {
+	for name, body := range map[string]string{
+		"LF":    "event: e\ndata: a\ndata: b\n\n",
+		"CR":    "event: e\rdata: a\rdata: b\r\r",
+		"CRLF":  "event: e\r\ndata: a\r\ndata: b\r\n\r\n",
+		"mixed": "event: e\rdata: a\r\ndata: b\n\r",
+	} {
+		msgs := collect(t, body, 1)
+		if msgs[0].EventType != "e" || msgs[0].Data != "a\nb" {
+			t.Errorf("%s: unexpected message %+v", name, msgs[0])
+		}
+	}
+}
+
+func TestLongLine(t *testing.T) {
+	data := strings.Repeat("x", 100*1024)
+	msgs := collect(t, "data: "+data+"\n\n", 1)
+	if msgs[0].Data != data {
+		t.Errorf("unexpected data of length %d", len(msgs[0].Data))
+	}
+}
+
+func TestBOM(t *testing.T) {
+	msgs := collect(t, "\ufeffdata: a\n\n", 1)
+	if msgs[0].Data != "a" {
+		t.Errorf("unexpected data %q", msgs[0].Data)
+	}
+}
+
+func TestComments(t *testing.T) {
+	comments := make(chan string, 2)
+	msgs := collectWith(t, ": ping\n:pong\ndata: a\n\n", 1, WithComments(comments))
+	if msgs[0].Data != "a" {
+		t.Errorf("unexpected data %q", msgs[0].Data)
+	}
+	for _, want := range []string{"ping", "pong"} {
+		if c := <-comments; c != want {
+			t.Errorf("unexpected comment %q, want %q", c, want)
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "text/event-stream")
+		io.WriteString(w, "retry: 10\ndata: a\n\n")
+		flush(w)
+		// stall
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	es := New(server.URL, WithIdleTimeout(50*time.Millisecond))
+	defer es.Close()
+
+	opened := 0
+	timeouts := 0
+	for opened < 2 {
+		select {
+		case <-es.OnOpen:
+			opened++
+		case <-es.OnMessage:
+		case err := <-es.OnError:
+			if err != ErrIdleTimeout {
+				t.Fatal(err)
+			}
+			timeouts++
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for reconnect")
+		}
+	}
+	if timeouts != 1 {
+		t.Errorf("got %d idle timeouts, want 1", timeouts)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestNewWithClient(t *testing.T) {
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"text/event-stream"}},
+			Body:       ioutil.NopCloser(strings.NewReader("data: a\n\n")),
+			Request:    req,
+		}, nil
+	})}
+	es := NewWithClient("http://example.invalid/", client)
+	defer es.Close()
+	<-es.OnOpen
+	select {
+	case msg := <-es.OnMessage:
+		if msg.Data != "a" {
+			t.Errorf("unexpected data %q", msg.Data)
+		}
+	case err := <-es.OnError:
+		t.Fatal(err)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	auth := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth <- r.Header.Get("Authorization")
+		w.Header().Add("Content-Type", "text/event-stream")
+		io.WriteString(w, "retry: 10\n\n")
+	}))
+	defer server.Close()
+
+	es := New(server.URL, WithHeaders(http.Header{"Authorization": {"Bearer secret"}}))
+	defer es.Close()
+	go func() {
+		for range es.OnOpen {
+		}
+	}()
+
+	// initial request and reconnect
+	for i := 0; i < 2; i++ {
+		select {
+		case a := <-auth:
+			if a != "Bearer secret" {
+				t.Errorf("request %d: unexpected Authorization header %q", i, a)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for request %d", i)
+		}
+	}
+}
+
+func TestNewWithContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: a\n\n")
+		flush(w)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	es := NewWithContext(ctx, server.URL)
+	<-es.OnOpen
+	<-es.OnMessage
+	cancel()
+	select {
+	case _, ok := <-es.OnMessage:
+		if ok {
+			t.Error("unexpected message after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnMessage not closed after cancel")
+	}
+	// Close after cancel must not block
+	es.Close()
+}
+
+func TestMaxRetries(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Add("Content-Type", "text/event-stream")
+			io.WriteString(w, "retry: 1\n\n")
+			return
+		}
+		http.Error(w, "gone", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	es := New(server.URL, WithBackoff(10*time.Millisecond), WithMaxRetries(3))
+	defer es.Close()
+
+	failures := 0
+	for {
+		select {
+		case <-es.OnOpen:
+		case err, ok := <-es.OnError:
+			if !ok {
+				t.Fatal("OnError closed before ErrTooManyRetries")
+			}
+			if err == ErrTooManyRetries {
+				if failures != 3 {
+					t.Errorf("got %d errors before giving up, want 3", failures)
+				}
+				if _, ok := <-es.OnMessage; ok {
+					t.Error("client not closed after giving up")
+				}
+				return
+			}
+			failures++
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	es := &EventSource{backoff: true, maxBackoff: time.Second}
+	retry := 100 * time.Millisecond
+	if d := es.retryDelay(retry, 0); d != retry {
+		t.Errorf("retryDelay without failures: got %v, want %v", d, retry)
+	}
+	for failures, max := range []time.Duration{0, 100, 200, 400, 800, 1000, 1000} {
+		if failures == 0 {
+			continue
+		}
+		max *= time.Millisecond
+		for i := 0; i < 100; i++ {
+			if d := es.retryDelay(retry, failures); d < max/2 || d > max {
+				t.Fatalf("retryDelay after %d failures: got %v, want %v to %v", failures, d, max/2, max)
+			}
+		}
+	}
+}
+
+func TestEventTypeWithoutData(t *testing.T) {
+	msgs := collect(t, "event: foo\n\ndata: a\n\n", 1)
+	if msgs[0].EventType != "" || msgs[0].Data != "a" {
+		t.Errorf("unexpected message %+v", msgs[0])
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "text/event-stream")
+		if atomic.AddInt32(&requests, 1) == 1 {
+			io.WriteString(w, "retry: 10000\n\n")
+		} else {
+			io.WriteString(w, "retry: 1x\n\n")
+		}
+	}))
+	defer server.Close()
+
+	delays := make(chan time.Duration)
+	es := newEventSource(context.Background(), server.URL)
+	es.after = func(d time.Duration) <-chan time.Time {
+		delays <- d
+		return time.After(0)
+	}
+	go es.receive()
+	defer es.Close()
+	go func() {
+		for range es.OnOpen {
+		}
+	}()
+
+	// the invalid value on the second connection is ignored
+	for i := 0; i < 2; i++ {
+		if d := <-delays; d != 10*time.Second {
+			t.Errorf("reconnect %d: got delay %v, want 10s", i, d)
+		}
+	}
+	go func() {
+		for range delays {
+		}
+	}()
+}
+
+func TestLastEventIDOnlyCommittedOnDispatch(t *testing.T) {
+	ids := make(chan string, 2)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case ids <- r.Header.Get("Last-Event-ID"):
+		default:
+		}
+		w.Header().Add("Content-Type", "text/event-stream")
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// the second event is cut off before it is dispatched
+			io.WriteString(w, "retry: 1\ndata: a\nid: 1\n\nid: 2\ndata: b\n")
+		}
+	}))
+	defer server.Close()
+
+	es := New(server.URL)
+	defer es.Close()
+	go func() {
+		for range es.OnOpen {
+		}
+	}()
+	if msg := <-es.OnMessage; msg.LastEventID != "1" {
+		t.Errorf("unexpected LastEventID %q", msg.LastEventID)
+	}
+	for _, want := range []string{"", "1"} {
+		select {
+		case id := <-ids:
+			if id != want {
+				t.Errorf("got Last-Event-ID %q, want %q", id, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for request")
+		}
+	}
+}
+
+func TestIDOnlyBlock(t *testing.T) {
+	ids := make(chan string, 2)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case ids <- r.Header.Get("Last-Event-ID"):
+		default:
+		}
+		w.Header().Add("Content-Type", "text/event-stream")
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// the id-only block is complete, but isn't dispatched
+			io.WriteString(w, "retry: 1\ndata: a\nid: 1\n\nid: 2\n\n")
+		}
+	}))
+	defer server.Close()
+
+	es := New(server.URL)
+	defer es.Close()
+	go func() {
+		for range es.OnOpen {
+		}
+	}()
+	<-es.OnMessage
+	for _, want := range []string{"", "1"} {
+		select {
+		case id := <-ids:
+			if id != want {
+				t.Errorf("got Last-Event-ID %q, want %q", id, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for request")
+		}
+	}
+
+	// the id doesn't carry over to the next event either
+	msgs := collect(t, "id: 1\ndata: a\n\nid: 2\n\ndata: b\n\n", 2)
+	if msgs[1].LastEventID != "1" {
+		t.Errorf("unexpected LastEventID %q", msgs[1].LastEventID)
+	}
+}
+
+func TestIDWithNUL(t *testing.T) {
+	msgs := collect(t, "id: 1\ndata: a\n\nid: 2\x003\ndata: b\n\n", 2)
+	if msgs[1].LastEventID != "1" {
+		t.Errorf("unexpected LastEventID %q", msgs[1].LastEventID)
+	}
+}
+
+func TestReconnects(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// failed connection attempts aren't reconnects
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Add("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: x\n\n")
+	}))
+	defer server.Close()
+
+	es := newEventSource(context.Background(), server.URL)
+	blocked := make(chan struct{})
+	calls := 0
+	es.after = func(d time.Duration) <-chan time.Time {
+		calls++
+		if calls == 3 {
+			// stop after the third lost connection; the retry after
+			// the failed attempt is immediate
+			close(blocked)
+			return nil
+		}
+		return time.After(0)
+	}
+	go es.receive()
+	defer es.Close()
+	go func() {
+		for range es.OnOpen {
+		}
+	}()
+	go func() {
+		for range es.OnMessage {
+		}
+	}()
+	go func() {
+		for range es.OnError {
+		}
+	}()
+
+	select {
+	case <-blocked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if n := es.Reconnects(); n != 3 {
+		t.Errorf("got %d reconnects, want 3", n)
+	}
+}
+
+func TestContentTypeWithCharset(t *testing.T) {
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"text/event-stream; charset=utf-8"}},
+			Body:       ioutil.NopCloser(strings.NewReader("data: a\n\n")),
+			Request:    req,
+		}, nil
+	})}
+	es := NewWithClient("http://example.invalid/", client)
+	defer es.Close()
+	select {
+	case <-es.OnOpen:
+	case err := <-es.OnError:
+		t.Fatal(err)
+	}
+	if msg := <-es.OnMessage; msg.Data != "a" {
+		t.Errorf("unexpected data %q", msg.Data)
+	}
+}
+
+func TestContentTypes(t *testing.T) {
+	es := newEventSource(context.Background(), "http://example.invalid/")
+	for _, test := range []struct {
+		ct     string
+		accept []string
+		want   bool
+	}{
+		{"text/event-stream", nil, true},
+		{"Text/Event-Stream; charset=UTF-8", nil, true},
+		{"text/plain", nil, false},
+		{"", nil, false},
+		{"application/x-ndjson", nil, false},
+		{"application/x-ndjson", []string{"text/event-stream", "application/x-ndjson"}, true},
+		{"text/event-stream", []string{"application/x-ndjson"}, false},
+		{"text/event-stream; charset=utf-8", []string{"TEXT/EVENT-STREAM"}, true},
+	} {
+		es.contentTypes = test.accept
+		if got := es.acceptsContentType(test.ct); got != test.want {
+			t.Errorf("acceptsContentType(%q) with %v = %v, want %v", test.ct, test.accept, got, test.want)
+		}
+	}
+}
+
+func TestQuickReconnect(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&requests, 1) {
+		case 1, 2:
+			// the first retry is immediate, the second one is delayed
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		case 3:
+			// a stable connection is re-established right away
+			w.Header().Add("Content-Type", "text/event-stream")
+			flush(w)
+			time.Sleep(50 * time.Millisecond)
+		default:
+			// short-lived connections are delayed
+			w.Header().Add("Content-Type", "text/event-stream")
+		}
+	}))
+	defer server.Close()
+
+	es := newEventSource(context.Background(), server.URL)
+	es.stable = 20 * time.Millisecond
+	delayed := make(chan int32, 10)
+	es.after = func(d time.Duration) <-chan time.Time {
+		delayed <- atomic.LoadInt32(&requests)
+		return time.After(0)
+	}
+	go es.receive()
+	defer es.Close()
+	go func() {
+		for range es.OnOpen {
+		}
+	}()
+	go func() {
+		for range es.OnError {
+		}
+	}()
+
+	// delays happen after the second failure and after the short-lived
+	// fourth connection
+	for _, want := range []int32{2, 4} {
+		select {
+		case n := <-delayed:
+			if n != want {
+				t.Errorf("delay after %d requests, want after %d", n, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestPartialEventDiscarded(t *testing.T) {
+	for _, c := range []struct {
+		body    string
+		discard bool
+	}{
+		{"data: a\n\nevent: x\ndata: b\n", true},
+		{"data: a\n\nevent: x\n", true},
+		{"data: a\n\n", false},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Content-Type", "text/event-stream")
+			io.WriteString(w, c.body)
+		}))
+
+		debug := make(chan string, 1)
+		es := newEventSource(context.Background(), server.URL, WithDebugf(func(format string, args ...interface{}) {
+			debug <- fmt.Sprintf(format, args...)
+		}))
+		reconnecting := make(chan struct{})
+		es.after = func(time.Duration) <-chan time.Time {
+			close(reconnecting)
+			return nil
+		}
+		go es.receive()
+		go func() {
+			for range es.OnOpen {
+			}
+		}()
+		if msg := <-es.OnMessage; msg.Data != "a" {
+			t.Errorf("%q: unexpected data %q", c.body, msg.Data)
+		}
+		select {
+		case <-reconnecting:
+		case <-time.After(time.Second):
+			t.Fatalf("%q: timeout waiting for reconnect", c.body)
+		}
+		select {
+		case msg := <-debug:
+			if !c.discard {
+				t.Errorf("%q: unexpected debug message %q", c.body, msg)
+			} else if !strings.Contains(msg, "partial event") {
+				t.Errorf("%q: unexpected debug message %q", c.body, msg)
+			}
+		default:
+			if c.discard {
+				t.Errorf("%q: no debug message for the partial event", c.body)
+			}
+		}
+		es.Close()
+		server.Close()
+	}
+}
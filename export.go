@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// exportQuiet is the time without changes to the cache after which it is
+// considered stable for exporting.
+var exportQuiet = 5 * time.Second
+
+// exportTimeout limits the time to wait for the cache to become stable. The
+// games are exported anyway afterwards.
+var exportTimeout = 2 * time.Minute
+
+// runExport monitors the leagues until the cache is stable after the first
+// init events, then writes all games to w in the given format (csv or json).
+func runExport(format string, leagues []League, w io.Writer) error {
+	if format != "csv" && format != "json" {
+		return fmt.Errorf("unknown export format %q", format)
+	}
+	cache := NewCache()
+	defer cache.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := cache.GameUpdates.RegisterBlocking()
+	var healths []*Health
+	for _, l := range leagues {
+		health := NewHealth()
+		health.League = l.Name
+		healths = append(healths, health)
+		go monitorGames(ctx, cache, health, l)
+	}
+
+	if !waitForStableCache(cache, healths, updates, exportQuiet, exportTimeout) {
+		log.WithField("timeout", exportTimeout.String()).Warn("export: cache not stable, exporting anyway")
+	}
+	cache.GameUpdates.Unregister(updates)
+	return writeExport(w, format, newAPIGames(cache.Get()))
+}
+
+// waitForStableCache waits until the first event of each league was received,
+// no address is pending, and there were no updates for quiet. It returns false
+// if this didn't happen within timeout.
+func waitForStableCache(c *Cache, hs []*Health, updates <-chan *CacheUpdate, quiet, timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	timer := time.NewTimer(quiet)
+	defer timer.Stop()
+	for {
+		select {
+		case <-updates:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-timer.C:
+			if checkAll(hs, time.Now()) == nil && !hasPendingAddrs(c.Get()) {
+				return true
+			}
+		case <-deadline.C:
+			return false
+		}
+		timer.Reset(quiet)
+	}
+}
+
+func hasPendingAddrs(games map[GameKey]CacheItem) bool {
+	for _, g := range games {
+		for _, a := range g.Addrs {
+			if a.Status == ConnectStatusPending {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeExport writes the games as a JSON list or as CSV with one row per
+// address. The source column tells games of different leagues apart. Games without addresses get a single row with empty address
+// columns.
+func writeExport(w io.Writer, format string, games []apiGame) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(games)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"source", "id", "title", "host", "engine", "status", "reachability", "joinable", "network", "addr", "addr_status", "last_checked", "reason"})
+		for _, g := range games {
+			game := []string{
+				g.Game.Source, strconv.Itoa(g.Game.ID), g.Game.Title, g.Game.Host, g.Game.Engine, g.Game.Status,
+				g.Status.String(), strconv.FormatBool(g.Joinable),
+			}
+			if len(g.Addrs) == 0 {
+				cw.Write(append(game, "", "", "", "", ""))
+			}
+			for _, a := range g.Addrs {
+				var lastChecked string
+				if !a.LastChecked.IsZero() {
+					lastChecked = a.LastChecked.Format(time.RFC3339)
+				}
+				row := append(append([]string(nil), game...), a.Addr.Network(), a.Addr.String(), a.Status.String(), lastChecked, a.Reason)
+				cw.Write(row)
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown export format %q", format)
+}
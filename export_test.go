@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitForStableCache(t *testing.T) {
+	c := NewCache()
+	defer c.Close()
+	h := NewHealth()
+	updates := c.GameUpdates.RegisterBlocking()
+	defer c.GameUpdates.Unregister(updates)
+	c.Checker = connectChecker(func(ctx context.Context, addr net.Addr) error {
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	})
+
+	// no league event yet
+	if waitForStableCache(c, []*Health{h}, updates, 10*time.Millisecond, 50*time.Millisecond) {
+		t.Error("stable before the first event")
+	}
+
+	h.SetOpen(true)
+	h.Updated(time.Now())
+	c.UpdateGame(LeagueGame{ID: 1})
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}})
+	start := time.Now()
+	if !waitForStableCache(c, []*Health{h}, updates, 10*time.Millisecond, 5*time.Second) {
+		t.Fatal("not stable")
+	}
+	// waits for the pending check
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("stable after %v, before the check finished", d)
+	}
+	if hasPendingAddrs(c.Get()) {
+		t.Error("pending addresses in stable cache")
+	}
+}
+
+func TestWriteExport(t *testing.T) {
+	games := []apiGame{
+		{Game: LeagueGame{ID: 1, Title: "foo, bar", Host: "host"}, Status: ConnectStatusSuccess, Addrs: []AddrStatus{
+			{Addr: &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}, Status: ConnectStatusSuccess, LastChecked: time.Date(2017, 3, 4, 19, 15, 0, 0, time.UTC)},
+			{Addr: &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11114}, Status: ConnectStatusFailure, Reason: "timeout"},
+		}},
+		{Game: LeagueGame{ID: 2}, Status: ConnectStatusFailure, Addrs: []AddrStatus{}},
+		{Game: LeagueGame{ID: 2, Source: "staging"}, Status: ConnectStatusFailure, Addrs: []AddrStatus{}},
+	}
+
+	var b bytes.Buffer
+	if err := writeExport(&b, "csv", games); err != nil {
+		t.Fatal(err)
+	}
+	want := `source,id,title,host,engine,status,reachability,joinable,network,addr,addr_status,last_checked,reason
+,1,"foo, bar",host,,,success,false,tcp,1.2.3.4:11113,success,2017-03-04T19:15:00Z,
+,1,"foo, bar",host,,,success,false,udp,1.2.3.4:11114,failure,,timeout
+,2,,,,,failure,false,,,,,
+staging,2,,,,,failure,false,,,,,
+`
+	if b.String() != want {
+		t.Errorf("got CSV\n%s\nwant\n%s", b.String(), want)
+	}
+
+	b.Reset()
+	if err := writeExport(&b, "json", games); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []apiGame
+	if err := json.Unmarshal(b.Bytes(), &decoded); err != nil || len(decoded) != 3 || len(decoded[0].Addrs) != 2 || decoded[2].Game.Source != "staging" {
+		t.Errorf("unexpected JSON %s (%v)", b.String(), err)
+	}
+
+	if err := writeExport(&b, "xml", games); err == nil || !strings.Contains(err.Error(), "xml") {
+		t.Errorf("got %v for unknown format", err)
+	}
+}
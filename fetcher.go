@@ -0,0 +1,190 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// fetchDebounce is the time a fetch is delayed after the first request for a
+// game. Further requests for the same game within this window don't cause
+// additional fetches, so a burst of league updates results in a single query.
+var fetchDebounce = time.Second
+
+// addrFetcher fetches game addresses from the league in the background and
+// passes them to the cache, so that slow league queries don't block the event
+// stream. Each league has its own addrFetcher.
+type addrFetcher struct {
+	cache *SourceCache
+	fetch func(ctx context.Context, id int) ([]net.Addr, error) // LeagueClient.GameAddresses, replaceable in tests
+
+	requestChan  chan int               // game ids to fetch
+	cancelChan   chan int               // game ids whose fetches to cancel
+	dueChan      chan *fetchJob         // jobs whose debounce window has expired
+	workChan     chan *fetchJob         // consumed by the fetch workers
+	finishedChan chan *fetchJob         // jobs finished by the workers
+	queue        *list.List             // of *fetchJob, waiting for a worker
+	pending      map[int]*fetchJob      // debouncing or in queue
+	running      map[*fetchJob]struct{} // handed out to a worker
+
+	ctx     context.Context    // cancelled by Close or the parent context, aborts running fetches
+	cancel  context.CancelFunc // cancels ctx
+	done    chan struct{}      // closed by Close
+	stopped chan struct{}      // closed once run has exited
+	workers sync.WaitGroup     // fetch workers
+}
+
+// fetchJob is a single fetch of a game's addresses.
+type fetchJob struct {
+	id     int
+	ctx    context.Context    // cancelled by Cancel or Close
+	cancel context.CancelFunc // cancels ctx
+	timer  *time.Timer        // debounce timer, nil without debouncing
+	elem   *list.Element      // position in queue, nil if not queued
+}
+
+// newAddrFetcher starts an addrFetcher with fetchConcurrency workers that query
+// the league using lc. Cancelling ctx aborts running fetches like Close, but
+// Close must still be called.
+func newAddrFetcher(ctx context.Context, c *SourceCache, lc *LeagueClient) *addrFetcher {
+	f := &addrFetcher{
+		cache:        c,
+		fetch:        lc.GameAddresses,
+		requestChan:  make(chan int),
+		cancelChan:   make(chan int),
+		dueChan:      make(chan *fetchJob),
+		workChan:     make(chan *fetchJob),
+		finishedChan: make(chan *fetchJob),
+		queue:        list.New(),
+		pending:      make(map[int]*fetchJob),
+		running:      make(map[*fetchJob]struct{}),
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+	f.ctx, f.cancel = context.WithCancel(ctx)
+	for i := 0; i < fetchConcurrency; i++ {
+		f.workers.Add(1)
+		go f.worker()
+	}
+	go f.run()
+	return f
+}
+
+// Fetch queues fetching the addresses of the given game after fetchDebounce. A
+// game that is already queued is only fetched once.
+func (f *addrFetcher) Fetch(id int) {
+	select {
+	case f.requestChan <- id:
+	case <-f.done:
+	}
+}
+
+// Cancel drops a queued fetch of the given game and aborts a running one, e.g.
+// because the game was deleted. A game created and deleted again within
+// fetchDebounce is thus never fetched.
+func (f *addrFetcher) Cancel(id int) {
+	select {
+	case f.cancelChan <- id:
+	case <-f.done:
+	}
+}
+
+// Close stops the fetcher, dropping queued games and cancelling running
+// fetches, and waits for the workers to exit.
+func (f *addrFetcher) Close() {
+	close(f.done)
+	f.cancel()
+	<-f.stopped
+}
+
+func (f *addrFetcher) run() {
+	defer func() {
+		close(f.workChan)
+		f.workers.Wait()
+		close(f.stopped)
+	}()
+	for {
+		// only try to hand out work if there is something queued
+		var workChan chan *fetchJob
+		var next *fetchJob
+		if f.queue.Len() > 0 {
+			workChan = f.workChan
+			next = f.queue.Front().Value.(*fetchJob)
+		}
+
+		select {
+		case <-f.done:
+			return
+		case id := <-f.requestChan:
+			if f.pending[id] != nil {
+				break
+			}
+			job := &fetchJob{id: id}
+			job.ctx, job.cancel = context.WithCancel(f.ctx)
+			f.pending[id] = job
+			if fetchDebounce > 0 {
+				job.timer = time.AfterFunc(fetchDebounce, func() {
+					select {
+					case f.dueChan <- job:
+					case <-f.done:
+					}
+				})
+			} else {
+				job.elem = f.queue.PushBack(job)
+			}
+		case id := <-f.cancelChan:
+			if job := f.pending[id]; job != nil {
+				job.cancel()
+				if job.timer != nil {
+					job.timer.Stop()
+				}
+				if job.elem != nil {
+					f.queue.Remove(job.elem)
+				}
+				delete(f.pending, id)
+			}
+			for job := range f.running {
+				if job.id == id {
+					job.cancel()
+				}
+			}
+		case job := <-f.dueChan:
+			// the timer may have fired before the job was cancelled
+			if f.pending[job.id] == job {
+				job.elem = f.queue.PushBack(job)
+			}
+		case workChan <- next:
+			f.queue.Remove(next.elem)
+			next.elem = nil
+			// requests arriving from now on need a new fetch
+			delete(f.pending, next.id)
+			f.running[next] = struct{}{}
+		case job := <-f.finishedChan:
+			job.cancel()
+			delete(f.running, job)
+		}
+	}
+}
+
+func (f *addrFetcher) worker() {
+	defer f.workers.Done()
+	for job := range f.workChan {
+		addrs, err := f.fetch(job.ctx, job.id)
+		switch {
+		case job.ctx.Err() != nil:
+			// cancelled by Cancel or Close
+		case err != nil:
+			log.WithError(err).WithField("id", job.id).Error("fetcher: error getting addresses")
+		default:
+			f.cache.UpdateAddrs(job.id, addrs)
+		}
+		select {
+		case f.finishedChan <- job:
+		case <-f.done:
+		}
+	}
+}
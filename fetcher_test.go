@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/clonkspot/gocrema/eventsource"
+)
+
+// waitForAddrs waits until all given games have n addresses in the cache.
+func waitForAddrs(t *testing.T, c *Cache, ids []int, n func(id int) int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for _, id := range ids {
+		for {
+			g, _ := c.GetGame(GameKey{ID: id})
+			if len(g.Addrs) == n(id) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("game %d has %d addresses, want %d", id, len(g.Addrs), n(id))
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestAddrFetcher(t *testing.T) {
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	lc, cleanup := leagueServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+		if r.URL.Query().Get("game_id") == "13" {
+			http.NotFound(w, r)
+			return
+		}
+		// fails quickly as the address cannot be resolved
+		io.WriteString(w, "Address=\"\"\nNetpuncherAddr=\"invalid\"\n  IPv4=1\n")
+	})
+	defer cleanup()
+	oldConcurrency := fetchConcurrency
+	fetchConcurrency = 4
+	defer func() { fetchConcurrency = oldConcurrency }()
+
+	c := NewCache()
+	defer c.Close()
+	f := newAddrFetcher(context.Background(), c.Source(""), lc)
+	defer f.Close()
+	var games []LeagueGame
+	var ids []int
+	for id := 1; id <= 20; id++ {
+		games = append(games, LeagueGame{ID: id})
+		ids = append(ids, id)
+	}
+	c.UpdateAllGames(games)
+	for _, id := range ids {
+		f.Fetch(id)
+	}
+
+	waitForAddrs(t, c, ids, func(id int) int {
+		if id == 13 {
+			return 0
+		}
+		return 1
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if maxActive > fetchConcurrency || maxActive < 2 {
+		t.Errorf("%d parallel requests, want 2 to %d", maxActive, fetchConcurrency)
+	}
+}
+
+func TestHandleGameEventFlood(t *testing.T) {
+	c := NewCache()
+	defer c.Close()
+	f := newAddrFetcher(context.Background(), c.Source(""), &LeagueClient{})
+	defer f.Close()
+	var mu sync.Mutex
+	fetches := 0
+	f.fetch = func(ctx context.Context, id int) ([]net.Addr, error) {
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+		// a slow league server
+		time.Sleep(50 * time.Millisecond)
+		return []net.Addr{&NetpuncherAddr{Net: "netpuncher4", Addr: "invalid", ID: uint64(id)}}, nil
+	}
+
+	var ids []int
+	for id := 1; id <= 10; id++ {
+		ids = append(ids, id)
+	}
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		data, _ := json.Marshal(LeagueGame{ID: ids[i%len(ids)], Title: "game"})
+		handleGameEvent(c.Source(""), f, eventsource.Message{EventType: "update", Data: string(data)})
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("handling the events took %v", d)
+	}
+
+	waitForAddrs(t, c, ids, func(int) int { return 1 })
+	mu.Lock()
+	defer mu.Unlock()
+	// queued fetches for the same game are merged
+	if fetches >= 1000 {
+		t.Errorf("%d fetches for 1000 events", fetches)
+	}
+}
+
+func TestAddrFetcherDebounce(t *testing.T) {
+	oldDebounce := fetchDebounce
+	fetchDebounce = 50 * time.Millisecond
+	defer func() { fetchDebounce = oldDebounce }()
+
+	c := NewCache()
+	defer c.Close()
+	f := newAddrFetcher(context.Background(), c.Source(""), &LeagueClient{})
+	defer f.Close()
+	fetches := make(chan int, 10)
+	f.fetch = func(ctx context.Context, id int) ([]net.Addr, error) {
+		fetches <- id
+		return []net.Addr{&NetpuncherAddr{Net: "netpuncher4", Addr: "invalid", ID: uint64(id)}}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		data, _ := json.Marshal(LeagueGame{ID: 1, Title: "game"})
+		handleGameEvent(c.Source(""), f, eventsource.Message{EventType: "update", Data: string(data)})
+	}
+	waitForAddrs(t, c, []int{1}, func(int) int { return 1 })
+	// wait for a possible second fetch
+	time.Sleep(2 * fetchDebounce)
+	if n := len(fetches); n != 1 {
+		t.Errorf("got %d fetches for two updates, want 1", n)
+	}
+
+	// a later update changing the status fetches again
+	data, _ := json.Marshal(LeagueGame{ID: 1, Title: "game", Status: "running"})
+	handleGameEvent(c.Source(""), f, eventsource.Message{EventType: "update", Data: string(data)})
+	time.Sleep(2 * fetchDebounce)
+	if n := len(fetches); n != 2 {
+		t.Errorf("got %d fetches after another update, want 2", n)
+	}
+}
+
+func TestHandleGameEventAddresses(t *testing.T) {
+	c := NewCache()
+	defer c.Close()
+	c.Checker = connectChecker(func(ctx context.Context, addr net.Addr) error { return nil })
+	f := newAddrFetcher(context.Background(), c.Source(""), &LeagueClient{})
+	fetched := make(chan int, 10)
+	f.fetch = func(ctx context.Context, id int) ([]net.Addr, error) {
+		fetched <- id
+		return nil, nil
+	}
+
+	data, _ := json.Marshal(LeagueGame{ID: 1, Addresses: []string{"TCP:1.2.3.4:11113"}})
+	handleGameEvent(c.Source(""), f, eventsource.Message{EventType: "create", Data: string(data)})
+	if g, _ := c.GetGame(GameKey{ID: 1}); len(g.Addrs) != 1 {
+		t.Errorf("got addresses %+v, want the one from the event", g.Addrs)
+	}
+	// without addresses in the event, they are fetched
+	data, _ = json.Marshal(LeagueGame{ID: 2})
+	handleGameEvent(c.Source(""), f, eventsource.Message{EventType: "create", Data: string(data)})
+
+	select {
+	case id := <-fetched:
+		if id != 2 {
+			t.Errorf("fetched game %d, want 2", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("addresses of game 2 not fetched")
+	}
+	f.Close()
+	if n := len(fetched); n != 0 {
+		t.Errorf("%d more fetches", n)
+	}
+}
+
+func TestHandleGameEventMetadataUpdate(t *testing.T) {
+	oldDebounce := fetchDebounce
+	fetchDebounce = 10 * time.Millisecond
+	defer func() { fetchDebounce = oldDebounce }()
+	var requests int32
+	lc, cleanup := leagueServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		io.WriteString(w, "[Reference]\nAddress=TCP:1.2.3.4:11113\n")
+	})
+	defer cleanup()
+
+	c := NewCache()
+	defer c.Close()
+	c.Checker = connectChecker(func(ctx context.Context, addr net.Addr) error { return nil })
+	f := newAddrFetcher(context.Background(), c.Source(""), lc)
+	defer f.Close()
+	send := func(typ string, game LeagueGame) {
+		data, _ := json.Marshal(game)
+		handleGameEvent(c.Source(""), f, eventsource.Message{EventType: typ, Data: string(data)})
+	}
+
+	game := LeagueGame{ID: 1, Host: "host", Status: "lobby"}
+	send("create", game)
+	waitForAddrs(t, c, []int{1}, func(int) int { return 1 })
+
+	game.Comment = "new comment"
+	game.MaxPlayers = 4
+	send("update", game)
+	time.Sleep(5 * fetchDebounce)
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("%d requests after a metadata-only update, want 1", n)
+	}
+	if g, _ := c.GetGame(GameKey{ID: 1}); g.Game.Comment != "new comment" || len(g.Addrs) != 1 {
+		t.Errorf("got comment %q with %d addresses after the update", g.Game.Comment, len(g.Addrs))
+	}
+
+	game.Status = "running"
+	send("update", game)
+	for i := 0; atomic.LoadInt32(&requests) != 2; i++ {
+		if i == 5000 {
+			t.Fatal("addresses not fetched again after a status change")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHandleGameEventCreateDelete(t *testing.T) {
+	oldDebounce := fetchDebounce
+	defer func() { fetchDebounce = oldDebounce }()
+
+	for _, debounce := range []time.Duration{50 * time.Millisecond, 0} {
+		fetchDebounce = debounce
+		c := NewCache()
+		f := newAddrFetcher(context.Background(), c.Source(""), &LeagueClient{})
+		started := make(chan int, 10)
+		aborted := make(chan int, 10)
+		completed := make(chan int, 10)
+		f.fetch = func(ctx context.Context, id int) ([]net.Addr, error) {
+			started <- id
+			if debounce == 0 {
+				// a slow league server, still running on delete
+				select {
+				case <-ctx.Done():
+					aborted <- id
+					return nil, ctx.Err()
+				case <-time.After(5 * time.Second):
+				}
+			}
+			completed <- id
+			return nil, nil
+		}
+
+		data, _ := json.Marshal(LeagueGame{ID: 1})
+		handleGameEvent(c.Source(""), f, eventsource.Message{EventType: "create", Data: string(data)})
+		if debounce == 0 {
+			<-started
+		}
+		handleGameEvent(c.Source(""), f, eventsource.Message{EventType: "delete", Data: string(data)})
+		if debounce == 0 {
+			select {
+			case <-aborted:
+			case <-time.After(time.Second):
+				t.Error("running fetch not aborted by delete")
+			}
+		}
+		time.Sleep(2 * debounce)
+		f.Close()
+		c.Close()
+		if debounce > 0 && len(started) != 0 {
+			t.Errorf("debounce %v: fetch started after delete", debounce)
+		}
+		if n := len(completed); n != 0 {
+			t.Errorf("debounce %v: %d completed fetches after delete", debounce, n)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// gameFilter selects the games that are monitored. Other games are ignored
+// when handling league events.
+var gameFilter GameFilter
+
+// GameFilter selects games by host and id.
+//
+// A game is allowed unless it matches any of the deny rules. If there are allow
+// rules, the game also has to match at least one of them. Thus, deny takes
+// precedence over allow, and an empty GameFilter allows all games.
+type GameFilter struct {
+	AllowHosts, DenyHosts []string // glob patterns for LeagueGame.Host, see path.Match
+	AllowIDs, DenyIDs     []IDRange
+}
+
+// IDRange is an inclusive range of game ids.
+type IDRange struct {
+	Min, Max int
+}
+
+// Allowed returns whether the game is selected by the filter.
+func (f *GameFilter) Allowed(g *LeagueGame) bool {
+	if matchHost(f.DenyHosts, g.Host) || matchID(f.DenyIDs, g.ID) {
+		return false
+	}
+	if len(f.AllowHosts) == 0 && len(f.AllowIDs) == 0 {
+		return true
+	}
+	return matchHost(f.AllowHosts, g.Host) || matchID(f.AllowIDs, g.ID)
+}
+
+// matchHost matches the host case-insensitively against the patterns.
+func matchHost(patterns []string, host string) bool {
+	host = strings.ToLower(host)
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchID(ranges []IDRange, id int) bool {
+	for _, r := range ranges {
+		if id >= r.Min && id <= r.Max {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHostPatterns parses a comma-separated list of glob patterns, e.g.
+// "*.example.com,host?".
+func parseHostPatterns(s string) ([]string, error) {
+	var patterns []string
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// parseIDRanges parses a comma-separated list of ids and inclusive ranges,
+// e.g. "12,100-200".
+func parseIDRanges(s string) ([]IDRange, error) {
+	var ranges []IDRange
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		min, max := r, r
+		if i := strings.Index(r, "-"); i >= 0 {
+			min, max = r[:i], r[i+1:]
+		}
+		var ir IDRange
+		var err error
+		if ir.Min, err = strconv.Atoi(strings.TrimSpace(min)); err != nil {
+			return nil, fmt.Errorf("invalid id range %q: %w", r, err)
+		}
+		if ir.Max, err = strconv.Atoi(strings.TrimSpace(max)); err != nil {
+			return nil, fmt.Errorf("invalid id range %q: %w", r, err)
+		}
+		if ir.Min > ir.Max {
+			return nil, fmt.Errorf("invalid id range %q: empty", r)
+		}
+		ranges = append(ranges, ir)
+	}
+	return ranges, nil
+}
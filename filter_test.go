@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/clonkspot/gocrema/eventsource"
+)
+
+func TestGameFilter(t *testing.T) {
+	game := func(id int, host string) *LeagueGame { return &LeagueGame{ID: id, Host: host} }
+	tests := []struct {
+		name    string
+		filter  GameFilter
+		allowed []*LeagueGame
+		denied  []*LeagueGame
+	}{
+		{"empty", GameFilter{}, []*LeagueGame{game(1, "foo")}, nil},
+		{
+			"allow hosts",
+			GameFilter{AllowHosts: []string{"*.example.com"}},
+			[]*LeagueGame{game(1, "a.example.com"), game(2, "B.Example.com")},
+			[]*LeagueGame{game(3, "example.com"), game(4, "")},
+		},
+		{
+			"allow hosts or ids",
+			GameFilter{AllowHosts: []string{"foo"}, AllowIDs: []IDRange{{10, 20}}},
+			[]*LeagueGame{game(1, "foo"), game(10, "bar"), game(20, "bar")},
+			[]*LeagueGame{game(21, "bar")},
+		},
+		{
+			"deny takes precedence",
+			GameFilter{AllowHosts: []string{"*"}, DenyHosts: []string{"spam*"}, DenyIDs: []IDRange{{5, 5}}},
+			[]*LeagueGame{game(1, "foo")},
+			[]*LeagueGame{game(2, "spammer"), game(5, "foo")},
+		},
+	}
+	for _, test := range tests {
+		for _, g := range test.allowed {
+			if !test.filter.Allowed(g) {
+				t.Errorf("%s: game %d (%s) denied", test.name, g.ID, g.Host)
+			}
+		}
+		for _, g := range test.denied {
+			if test.filter.Allowed(g) {
+				t.Errorf("%s: game %d (%s) allowed", test.name, g.ID, g.Host)
+			}
+		}
+	}
+}
+
+func TestParseGameFilter(t *testing.T) {
+	if p, err := parseHostPatterns(" *.example.com, foo ,"); err != nil || !reflect.DeepEqual(p, []string{"*.example.com", "foo"}) {
+		t.Errorf("parseHostPatterns: %v, %v", p, err)
+	}
+	if _, err := parseHostPatterns("[a-"); err == nil {
+		t.Error("parseHostPatterns: no error for invalid pattern")
+	}
+	if r, err := parseIDRanges("12, 100-200"); err != nil || !reflect.DeepEqual(r, []IDRange{{12, 12}, {100, 200}}) {
+		t.Errorf("parseIDRanges: %v, %v", r, err)
+	}
+	for _, s := range []string{"x", "1-", "-1", "5-3"} {
+		if _, err := parseIDRanges(s); err == nil {
+			t.Errorf("parseIDRanges(%q): no error", s)
+		}
+	}
+}
+
+func TestHandleGameEventFilter(t *testing.T) {
+	oldFilter := gameFilter
+	gameFilter = GameFilter{DenyHosts: []string{"spam"}}
+	defer func() { gameFilter = oldFilter }()
+
+	c := NewCache()
+	defer c.Close()
+	f := newAddrFetcher(context.Background(), c.Source(""), &LeagueClient{})
+	fetched := make(chan int, 10)
+	f.fetch = func(ctx context.Context, id int) ([]net.Addr, error) {
+		fetched <- id
+		return nil, nil
+	}
+	event := func(typ string, data interface{}) {
+		d, _ := json.Marshal(data)
+		handleGameEvent(c.Source(""), f, eventsource.Message{EventType: typ, Data: string(d)})
+	}
+
+	event("init", []LeagueGame{{ID: 1, Host: "foo"}, {ID: 2, Host: "spam"}})
+	event("create", LeagueGame{ID: 3, Host: "spam"})
+	if games := c.Get(); len(games) != 1 || games[GameKey{ID: 1}].Game.Host != "foo" {
+		t.Errorf("unexpected games %+v", games)
+	}
+
+	// a game that becomes filtered is removed
+	event("update", LeagueGame{ID: 1, Host: "spam"})
+	if games := c.Get(); len(games) != 0 {
+		t.Errorf("unexpected games %+v", games)
+	}
+
+	f.Close()
+	close(fetched)
+	for id := range fetched {
+		if id != 1 {
+			t.Errorf("fetched addresses of filtered game %d", id)
+		}
+	}
+}
+
+func TestHandleGameEventFilterCancelsFetch(t *testing.T) {
+	oldFilter, oldDebounce := gameFilter, fetchDebounce
+	gameFilter, fetchDebounce = GameFilter{DenyHosts: []string{"spam"}}, 0
+	defer func() { gameFilter, fetchDebounce = oldFilter, oldDebounce }()
+
+	c := NewCache()
+	defer c.Close()
+	f := newAddrFetcher(context.Background(), c.Source(""), &LeagueClient{})
+	defer f.Close()
+	started := make(chan int, 10)
+	aborted := make(chan int, 10)
+	f.fetch = func(ctx context.Context, id int) ([]net.Addr, error) {
+		started <- id
+		// a slow league server, still running on the update
+		select {
+		case <-ctx.Done():
+			aborted <- id
+			return nil, ctx.Err()
+		case <-time.After(5 * time.Second):
+			return nil, nil
+		}
+	}
+	event := func(typ string, data interface{}) {
+		d, _ := json.Marshal(data)
+		handleGameEvent(c.Source(""), f, eventsource.Message{EventType: typ, Data: string(d)})
+	}
+
+	event("create", LeagueGame{ID: 1, Host: "foo"})
+	<-started
+	event("update", LeagueGame{ID: 1, Host: "spam"})
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Error("fetch of the filtered game not aborted")
+	}
+}
@@ -1,7 +1,40 @@
 package main
 
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// leagueTimeLayout is the layout of the created and updated timestamps in
+// game_events.php, which formats them with PHP's date('c'), e.g.
+// "2017-03-04T20:15:00+01:00".
+const leagueTimeLayout = time.RFC3339
+
+// GameKey identifies a game across leagues. Game ids are only unique within a
+// single league.
+type GameKey struct {
+	Source string // league name, see LeagueGame.Source
+	ID     int
+}
+
+// String returns the id, prefixed with the source if set, e.g. "staging-42".
+func (k GameKey) String() string {
+	if k.Source == "" {
+		return strconv.Itoa(k.ID)
+	}
+	return k.Source + "-" + strconv.Itoa(k.ID)
+}
+
 // LeagueGame is a JSON-encoded game as returned by game_events.php
 type LeagueGame struct {
+	// Source is the name of the league the game was announced by. It is set
+	// by CREMA and empty with a single unnamed league.
+	Source      string `json:"source,omitempty"`
 	ID          int    `json:"id"`
 	Title       string `json:"title"`
 	Status      string `json:"status"`
@@ -29,4 +62,81 @@ type LeagueGame struct {
 		Team  int    `json:"team"`
 		Color int    `json:"color"`
 	} `json:"players"`
+	// Addresses optionally lists the game's addresses as network:address,
+	// e.g. "TCP:1.2.3.4:11113" or "netpuncher4:netpuncher.example.com:11115#42".
+	// If nil, the addresses have to be queried from the league.
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// Key returns the key of the game in the cache.
+func (g *LeagueGame) Key() GameKey {
+	return GameKey{Source: g.Source, ID: g.ID}
+}
+
+// addrsChanged reports whether the game's addresses may differ from those of
+// the old version of the game, so that they have to be fetched again. The
+// addresses only change with the host, e.g. after a host migration, or with
+// the status, e.g. when a lobby starts running. Changes of all other fields,
+// such as players joining or a new comment, keep the addresses.
+func (g *LeagueGame) addrsChanged(old *LeagueGame) bool {
+	return g.Host != old.Host || g.Status != old.Status
+}
+
+// ParseAddresses parses Addresses. Malformed addresses are skipped, like in
+// LeagueClient.GameAddresses.
+func (g *LeagueGame) ParseAddresses() []net.Addr {
+	var addrs []net.Addr
+	for _, s := range g.Addresses {
+		a, err := parseLeagueAddr(s)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{"id": g.ID, "addr": s}).Debug("ParseAddresses: skipping address")
+			continue
+		}
+		addrs = append(addrs, a)
+	}
+	return addrs
+}
+
+// parseLeagueAddr parses an address in the form network:address, where the
+// network is case-insensitive.
+func parseLeagueAddr(s string) (net.Addr, error) {
+	network, addr, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, fmt.Errorf("missing network in %q", s)
+	}
+	return parseAddr(strings.ToLower(network), addr)
+}
+
+// CreatedTime returns the creation time of the game. It returns the zero time
+// if the league didn't send one.
+func (g *LeagueGame) CreatedTime() (time.Time, error) {
+	return parseLeagueTime(g.Created)
+}
+
+// UpdatedTime returns the time of the last update to the game. It returns the
+// zero time if the league didn't send one.
+func (g *LeagueGame) UpdatedTime() (time.Time, error) {
+	return parseLeagueTime(g.Updated)
+}
+
+// PlayerCount returns the number of players in the game.
+func (g *LeagueGame) PlayerCount() int {
+	return len(g.Players)
+}
+
+// TeamCounts returns the number of players per team. Players that aren't in a
+// team are counted for team 0, so that the counts add up to PlayerCount.
+func (g *LeagueGame) TeamCounts() map[int]int {
+	counts := make(map[int]int)
+	for _, p := range g.Players {
+		counts[p.Team]++
+	}
+	return counts
+}
+
+func parseLeagueTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(leagueTimeLayout, s)
 }
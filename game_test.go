@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLeagueGameTimes(t *testing.T) {
+	g := LeagueGame{Created: "2017-03-04T20:15:00+01:00", Updated: ""}
+	created, err := g.CreatedTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2017, 3, 4, 19, 15, 0, 0, time.UTC); !created.Equal(want) {
+		t.Errorf("CreatedTime() = %v, want %v", created, want)
+	}
+	if updated, err := g.UpdatedTime(); err != nil || !updated.IsZero() {
+		t.Errorf("UpdatedTime() = %v, %v for empty string", updated, err)
+	}
+
+	g.Updated = "yesterday"
+	if updated, err := g.UpdatedTime(); err == nil || !updated.IsZero() {
+		t.Errorf("UpdatedTime() = %v, %v for malformed input", updated, err)
+	}
+}
+
+func TestLeagueGamePlayers(t *testing.T) {
+	var g LeagueGame
+	if n := g.PlayerCount(); n != 0 {
+		t.Errorf("PlayerCount() = %d without players", n)
+	}
+	if counts := g.TeamCounts(); counts == nil || len(counts) != 0 {
+		t.Errorf("TeamCounts() = %v without players", counts)
+	}
+
+	if err := json.Unmarshal([]byte(`{"players": [{"team": 1}, {"team": 2}, {"team": 1}, {"team": 0}]}`), &g); err != nil {
+		t.Fatal(err)
+	}
+	if n := g.PlayerCount(); n != 4 {
+		t.Errorf("PlayerCount() = %d, want 4", n)
+	}
+	if counts, want := g.TeamCounts(), map[int]int{0: 1, 1: 2, 2: 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("TeamCounts() = %v, want %v", counts, want)
+	}
+}
+
+func TestGameKey(t *testing.T) {
+	g := LeagueGame{ID: 42}
+	if k := g.Key(); k != (GameKey{ID: 42}) || k.String() != "42" {
+		t.Errorf("got %+v (%s)", k, k)
+	}
+	g.Source = "staging"
+	if k := g.Key(); k != (GameKey{"staging", 42}) || k.String() != "staging-42" {
+		t.Errorf("got %+v (%s)", k, k)
+	}
+}
+
+func TestParseAddresses(t *testing.T) {
+	g := LeagueGame{Addresses: []string{
+		"TCP:1.2.3.4:11113",
+		"udp:[2001:db8::1]:11113",
+		"netpuncher4:netpuncher.example.com:11115#42",
+		"1.2.3.4:11113",
+		"SCTP:1.2.3.4:11113",
+		"TCP:invalid",
+	}}
+	var got []string
+	for _, a := range g.ParseAddresses() {
+		got = append(got, a.Network()+" "+a.String())
+	}
+	want := []string{"tcp 1.2.3.4:11113", "udp [2001:db8::1]:11113", "netpuncher4 netpuncher.example.com:11115#42"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
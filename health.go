@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// healthMaxAge is the maximum time since the last league event for CREMA to be
+// considered healthy. Zero disables the check.
+var healthMaxAge = time.Hour
+
+// addrsMissingMaxRatio is the maximum ratio of games whose addresses couldn't
+// be fetched for CREMA to be considered healthy. A high ratio indicates that
+// the league server fails address queries. Values of 1 or more disable the
+// check.
+var addrsMissingMaxRatio = 0.5
+
+// addrsFetchGrace is the time a new game may be without fetched addresses
+// before it counts as missing them.
+var addrsFetchGrace = time.Minute
+
+// Health tracks the connection to the league event stream.
+type Health struct {
+	League string // name of the league, if there are several
+	st     chan healthState
+}
+
+type healthState struct {
+	open       bool      // the event stream is connected
+	lastUpdate time.Time // time of the last league event
+}
+
+// NewHealth creates a Health that is unhealthy until the event stream is
+// connected and an event was received.
+func NewHealth() *Health {
+	h := &Health{st: make(chan healthState, 1)}
+	h.st <- healthState{}
+	return h
+}
+
+// SetOpen records whether the event stream is connected.
+func (h *Health) SetOpen(open bool) {
+	st := <-h.st
+	st.open = open
+	h.st <- st
+}
+
+// Updated records that a league event was received.
+func (h *Health) Updated(now time.Time) {
+	st := <-h.st
+	st.lastUpdate = now
+	h.st <- st
+}
+
+// Check returns nil if the event stream is connected and the last event is no
+// older than healthMaxAge, or the reason why not.
+func (h *Health) Check(now time.Time) error {
+	st := <-h.st
+	h.st <- st
+	switch {
+	case !st.open:
+		return errors.New("event stream not connected")
+	case st.lastUpdate.IsZero():
+		return errors.New("no league events received yet")
+	case healthMaxAge > 0 && now.Sub(st.lastUpdate) > healthMaxAge:
+		return fmt.Errorf("no league events since %s", st.lastUpdate.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// healthHandler responds with 200 if all leagues are healthy and the addresses
+// of the games in cache could be fetched, and 503 otherwise. cache may be nil
+// to skip the latter.
+func healthHandler(cache *Cache, hs ...*Health) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		now := time.Now()
+		err := checkAll(hs, now)
+		if err == nil && cache != nil {
+			err = checkAddrsFetched(cache, now)
+		}
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unhealthy", "reason": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// checkAll returns the first reason why one of hs is unhealthy, prefixed with
+// the league name if set.
+func checkAll(hs []*Health, now time.Time) error {
+	for _, h := range hs {
+		if err := h.Check(now); err != nil {
+			if h.League != "" {
+				return fmt.Errorf("league %s: %w", h.League, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// checkAddrsFetched returns an error if the ratio of games with missing
+// addresses exceeds addrsMissingMaxRatio.
+func checkAddrsFetched(c *Cache, now time.Time) error {
+	if addrsMissingMaxRatio >= 1 {
+		return nil
+	}
+	missing, total := c.CountAddrsMissing(now)
+	if total > 0 && float64(missing)/float64(total) > addrsMissingMaxRatio {
+		return fmt.Errorf("addresses of %d of %d games not fetched", missing, total)
+	}
+	return nil
+}
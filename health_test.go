@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestHealth(t *testing.T) {
+	oldMaxAge := healthMaxAge
+	healthMaxAge = time.Minute
+	defer func() { healthMaxAge = oldMaxAge }()
+
+	h := NewHealth()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/healthz", healthHandler(nil, h))
+	status := func() int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+		return w.Code
+	}
+
+	if code := status(); code != http.StatusServiceUnavailable {
+		t.Errorf("initial status %d", code)
+	}
+	h.SetOpen(true)
+	if err := h.Check(time.Now()); err == nil {
+		t.Error("healthy without any events")
+	}
+	now := time.Now()
+	h.Updated(now)
+	if code := status(); code != http.StatusOK {
+		t.Errorf("status %d after update", code)
+	}
+	if err := h.Check(now.Add(2 * time.Minute)); err == nil {
+		t.Error("healthy with stale events")
+	}
+	h.SetOpen(false)
+	if code := status(); code != http.StatusServiceUnavailable {
+		t.Errorf("status %d after disconnect", code)
+	}
+}
+
+func TestCheckAll(t *testing.T) {
+	a, b := NewHealth(), NewHealth()
+	b.League = "staging"
+	now := time.Now()
+	a.SetOpen(true)
+	a.Updated(now)
+	if err := checkAll([]*Health{a, b}, now); err == nil || err.Error() != "league staging: event stream not connected" {
+		t.Errorf("got %v", err)
+	}
+	b.SetOpen(true)
+	b.Updated(now)
+	if err := checkAll([]*Health{a, b}, now); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckAddrsFetched(t *testing.T) {
+	oldGrace := addrsFetchGrace
+	addrsFetchGrace = 0
+	defer func() { addrsFetchGrace = oldGrace }()
+
+	c := NewCache()
+	defer c.Close()
+	c.UpdateGame(LeagueGame{ID: 1})
+	c.UpdateGame(LeagueGame{ID: 2})
+	now := time.Now().Add(time.Second)
+	if missing, total := c.CountAddrsMissing(now); missing != 2 || total != 2 {
+		t.Errorf("%d of %d missing, want 2 of 2", missing, total)
+	}
+	if err := checkAddrsFetched(c, now); err == nil {
+		t.Error("healthy without any addresses")
+	}
+
+	// an empty address list counts as fetched
+	c.UpdateAddrs(GameKey{ID: 1}, nil)
+	if g, _ := c.GetGame(GameKey{ID: 1}); !g.AddrsFetched {
+		t.Error("addresses not marked as fetched")
+	}
+	if missing, _ := c.CountAddrsMissing(now); missing != 1 {
+		t.Errorf("%d missing, want 1", missing)
+	}
+	if err := checkAddrsFetched(c, now); err != nil {
+		t.Error(err)
+	}
+	// new games are within the grace period
+	addrsFetchGrace = time.Hour
+	if missing, _ := c.CountAddrsMissing(now); missing != 0 {
+		t.Errorf("%d missing within grace period", missing)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// League is a league server whose games are monitored.
+type League struct {
+	Name      string // identifies the league in LeagueGame.Source, may be empty with a single league
+	EventsURL string // URL to the event stream, see GameEventsURL
+	LeagueURL string // URL to the league server, see LeagueURL
+}
+
+// defaultLeagues returns the single unnamed league configured by
+// GameEventsURL and LeagueURL.
+func defaultLeagues() []League {
+	return []League{{EventsURL: GameEventsURL, LeagueURL: LeagueURL}}
+}
+
+// parseLeagues parses a whitespace-separated list of leagues in the form
+// name=eventsURL,leagueURL, e.g.
+// "prod=https://example.com/game_events.php,http://league.example.com:80/".
+// Names must be unique and non-empty.
+func parseLeagues(s string) ([]League, error) {
+	var leagues []League
+	names := make(map[string]bool)
+	for _, entry := range strings.Fields(s) {
+		i := strings.Index(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid league %q: missing name", entry)
+		}
+		name, urls := entry[:i], entry[i+1:]
+		if names[name] {
+			return nil, fmt.Errorf("duplicate league %q", name)
+		}
+		names[name] = true
+		events, league, ok := strings.Cut(urls, ",")
+		if !ok {
+			return nil, fmt.Errorf("invalid league %q: want name=eventsURL,leagueURL", entry)
+		}
+		for _, u := range []string{events, league} {
+			if _, err := url.ParseRequestURI(u); err != nil {
+				return nil, fmt.Errorf("invalid league %q: %w", entry, err)
+			}
+		}
+		leagues = append(leagues, League{Name: name, EventsURL: events, LeagueURL: league})
+	}
+	if len(leagues) == 0 {
+		return nil, fmt.Errorf("no leagues in %q", s)
+	}
+	return leagues, nil
+}
+
+// clonkHost returns the league server address for clonk:// links.
+func (l *League) clonkHost() string {
+	return strings.Replace(l.LeagueURL, "http://", "", 1)
+}
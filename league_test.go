@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/clonkspot/gocrema/eventsource"
+)
+
+func TestParseLeagues(t *testing.T) {
+	leagues, err := parseLeagues(" prod=https://a.example/events,http://a.example:80/\n staging=https://b.example/events,http://b.example/ ")
+	want := []League{
+		{Name: "prod", EventsURL: "https://a.example/events", LeagueURL: "http://a.example:80/"},
+		{Name: "staging", EventsURL: "https://b.example/events", LeagueURL: "http://b.example/"},
+	}
+	if err != nil || !reflect.DeepEqual(leagues, want) {
+		t.Errorf("parseLeagues: %+v, %v", leagues, err)
+	}
+	for _, s := range []string{
+		"",
+		"https://a.example/events,http://a.example/",
+		"=https://a.example/events,http://a.example/",
+		"a=https://a.example/events",
+		"a=https://a.example/events,",
+		"a=x,y",
+		"a=https://a.example/events,http://a.example/ a=https://b.example/events,http://b.example/",
+	} {
+		if _, err := parseLeagues(s); err == nil {
+			t.Errorf("parseLeagues(%q): no error", s)
+		}
+	}
+}
+
+func TestHandleGameEventSources(t *testing.T) {
+	c := NewCache()
+	defer c.Close()
+	event := func(source, typ string, data interface{}) {
+		s := c.Source(source)
+		f := newAddrFetcher(context.Background(), s, &LeagueClient{})
+		defer f.Close()
+		f.fetch = func(ctx context.Context, id int) ([]net.Addr, error) { return nil, nil }
+		d, _ := json.Marshal(data)
+		handleGameEvent(s, f, eventsource.Message{EventType: typ, Data: string(d)})
+	}
+
+	event("prod", "init", []LeagueGame{{ID: 1}, {ID: 2}})
+	event("staging", "init", []LeagueGame{{ID: 2}, {ID: 3}})
+	// a second init only replaces the games of its own league
+	event("prod", "init", []LeagueGame{{ID: 2}})
+	games := c.Get()
+	if len(games) != 3 || games[GameKey{"prod", 2}].Game.Source != "prod" || games[GameKey{"staging", 2}].Game.Source != "staging" {
+		t.Errorf("unexpected games %+v", games)
+	}
+
+	// the same id in another league is a different game
+	event("staging", "delete", LeagueGame{ID: 2})
+	if _, ok := c.GetGame(GameKey{"prod", 2}); !ok {
+		t.Error("game deleted by another league")
+	}
+	if _, ok := c.GetGame(GameKey{"staging", 2}); ok {
+		t.Error("game not deleted by its league")
+	}
+	if games := c.Source("staging").Get(); len(games) != 1 || games[3].Game.ID != 3 {
+		t.Errorf("unexpected staging games %+v", games)
+	}
+}
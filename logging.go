@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// summaryInterval is the interval in which a summary of all games is logged.
+// Zero disables the summary.
+var summaryInterval time.Duration
+
+// logGameUpdates logs every change to the cache until updates is closed. It
+// keeps track of the previous state of every game so that only the changed
+// addresses are logged.
+func logGameUpdates(updates <-chan *CacheUpdate) {
+	games := make(map[GameKey]*CacheItem)
+	var summary <-chan time.Time
+	if summaryInterval > 0 {
+		ticker := time.NewTicker(summaryInterval)
+		defer ticker.Stop()
+		summary = ticker.C
+	}
+
+	for {
+		select {
+		case u, ok := <-updates:
+			if !ok {
+				return
+			}
+			logGameUpdate(games[u.Key], u)
+			if u.G != nil {
+				games[u.Key] = u.G
+			} else {
+				delete(games, u.Key)
+			}
+		case <-summary:
+			counts := make(map[ConnectStatus]int)
+			addrsMissing := 0
+			for _, g := range games {
+				counts[g.Reachability()]++
+				if !g.AddrsFetched {
+					addrsMissing++
+				}
+			}
+			log.WithFields(log.Fields{
+				"games":         len(games),
+				"success":       counts[ConnectStatusSuccess],
+				"pending":       counts[ConnectStatusPending],
+				"failure":       counts[ConnectStatusFailure],
+				"addrs_missing": addrsMissing,
+			}).Info("summary")
+		}
+	}
+}
+
+// logGameUpdate logs the difference between the previous state of a game (nil
+// if it's new) and the update.
+func logGameUpdate(prev *CacheItem, u *CacheUpdate) {
+	ctx := log.WithField("id", u.Key.ID)
+	if u.Key.Source != "" {
+		ctx = ctx.WithField("league", u.Key.Source)
+	}
+	if u.G == nil {
+		if prev != nil {
+			ctx = ctx.WithField("title", prev.Game.Title)
+		}
+		ctx.Info("game removed")
+		return
+	}
+	ctx = ctx.WithField("title", u.G.Game.Title)
+	if prev == nil {
+		ctx.Info("game added")
+		prev = &CacheItem{}
+	} else if !reflect.DeepEqual(prev.Game, u.G.Game) {
+		ctx.Debug("game updated")
+	}
+	for key, a := range u.G.Addrs {
+		if old, ok := prev.Addrs[key]; ok && old.Status == a.Status {
+			continue
+		}
+		ctx.WithFields(log.Fields{
+			"addr":   key,
+			"status": a.Status.String(),
+		}).Info("address status")
+	}
+	for key := range prev.Addrs {
+		if _, ok := u.G.Addrs[key]; !ok {
+			ctx.WithField("addr", key).Info("address removed")
+		}
+	}
+}
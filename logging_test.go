@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/apex/log"
+)
+
+func TestLogGameUpdates(t *testing.T) {
+	var entries []*log.Entry
+	oldLog := log.Log
+	log.Log = &log.Logger{
+		Handler: log.HandlerFunc(func(e *log.Entry) error {
+			entries = append(entries, e)
+			return nil
+		}),
+		Level: log.InfoLevel,
+	}
+	defer func() { log.Log = oldLog }()
+
+	tcp := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}
+	udp := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11114}
+	item := func(title string, tcpStatus, udpStatus ConnectStatus) *CacheItem {
+		return &CacheItem{
+			Game: LeagueGame{ID: 1, Title: title},
+			Addrs: map[string]CacheItemAddr{
+				cacheAddrKey(tcp): {Addr: tcp, Status: tcpStatus},
+				cacheAddrKey(udp): {Addr: udp, Status: udpStatus},
+			},
+		}
+	}
+
+	updates := make(chan *CacheUpdate, 10)
+	updates <- &CacheUpdate{Key: GameKey{ID: 1}, G: item("foo", ConnectStatusPending, ConnectStatusPending)}
+	updates <- &CacheUpdate{Key: GameKey{ID: 1}, G: item("foo", ConnectStatusSuccess, ConnectStatusPending)}
+	updates <- &CacheUpdate{Key: GameKey{ID: 1}, G: item("bar", ConnectStatusSuccess, ConnectStatusPending)}
+	updates <- &CacheUpdate{Key: GameKey{ID: 1}}
+	close(updates)
+	logGameUpdates(updates)
+
+	want := []struct {
+		msg, addr, status string
+	}{
+		{"game added", "", ""},
+		{"address status", "tcp:1.2.3.4:11113", "pending"},
+		{"address status", "udp:1.2.3.4:11114", "pending"},
+		{"address status", "tcp:1.2.3.4:11113", "success"},
+		{"game removed", "", ""},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d log entries, want %d", len(entries), len(want))
+	}
+	// addresses of a new game are logged in random order
+	if entries[1].Fields["addr"] == want[2].addr {
+		entries[1], entries[2] = entries[2], entries[1]
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.Message != w.msg || e.Fields["id"] != 1 {
+			t.Errorf("entry %d: got %q %v, want %q", i, e.Message, e.Fields, w.msg)
+		}
+		if w.addr != "" && (e.Fields["addr"] != w.addr || e.Fields["status"] != w.status) {
+			t.Errorf("entry %d: got %v, want addr %s, status %s", i, e.Fields, w.addr, w.status)
+		}
+	}
+	if title := entries[4].Fields["title"]; title != "bar" {
+		t.Errorf("removed game has title %v", title)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metrics holds the metrics served on /metrics.
+var metrics = NewMetrics()
+
+// Metrics is a minimal registry of metrics in the Prometheus text format.
+type Metrics struct {
+	st chan map[string]metric
+}
+
+type metric struct {
+	typ   string // counter or gauge
+	help  string
+	value func() float64
+	// collect returns the values of all metrics of a collector by name, if
+	// the metric was registered with RegisterCollector instead of value
+	collect *func() map[string]float64
+}
+
+// MetricDesc describes a metric of a collector.
+type MetricDesc struct {
+	Name string // may include labels, as for Register
+	Type string // counter or gauge
+	Help string
+}
+
+// NewMetrics creates an empty registry.
+func NewMetrics() *Metrics {
+	m := &Metrics{st: make(chan map[string]metric, 1)}
+	m.st <- make(map[string]metric)
+	return m
+}
+
+// Register adds a metric whose value is read from the given function on every
+// scrape. An existing metric with the same name is replaced. The name may
+// include labels, e.g. `name{label="value"}`; series of the same metric share
+// the help and type of the first one.
+func (m *Metrics) Register(name, typ, help string, value func() float64) {
+	st := <-m.st
+	st[name] = metric{typ: typ, help: help, value: value}
+	m.st <- st
+}
+
+// RegisterCollector adds the described metrics, whose values are all read from
+// a single call of collect on every scrape. Unlike separate Register calls,
+// this gives values that are consistent with each other, e.g. counts from
+// the same snapshot. collect returns the values by metric name; metrics
+// missing from its result are reported as zero.
+func (m *Metrics) RegisterCollector(descs []MetricDesc, collect func() map[string]float64) {
+	st := <-m.st
+	for _, d := range descs {
+		st[d.Name] = metric{typ: d.Type, help: d.Help, collect: &collect}
+	}
+	m.st <- st
+}
+
+// String formats all metrics, sorted by family name and then by series.
+func (m *Metrics) String() string {
+	// copy the metrics so that slow value functions, e.g. waiting for the
+	// cache, don't block registrations and other scrapes
+	st := <-m.st
+	ms := make(map[string]metric, len(st))
+	names := make([]string, 0, len(st))
+	for name, mt := range st {
+		ms[name] = mt
+		names = append(names, name)
+	}
+	m.st <- st
+
+	// sorting by the full name would put foo_bar between foo and foo{...}
+	sort.Slice(names, func(i, j int) bool {
+		fi, fj := metricFamily(names[i]), metricFamily(names[j])
+		if fi != fj {
+			return fi < fj
+		}
+		return names[i] < names[j]
+	})
+	var b strings.Builder
+	var family string
+	collected := make(map[*func() map[string]float64]map[string]float64)
+	for _, name := range names {
+		mt := ms[name]
+		if f := metricFamily(name); f != family {
+			family = f
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f, mt.help, f, mt.typ)
+		}
+		var value float64
+		if mt.collect != nil {
+			values, ok := collected[mt.collect]
+			if !ok {
+				values = (*mt.collect)()
+				collected[mt.collect] = values
+			}
+			value = values[name]
+		} else {
+			value = mt.value()
+		}
+		fmt.Fprintf(&b, "%s %v\n", name, value)
+	}
+	return b.String()
+}
+
+// metricFamily returns the metric name without labels.
+func metricFamily(name string) string {
+	f, _, _ := strings.Cut(name, "{")
+	return f
+}
+
+// metricsHandler serves the metrics in the Prometheus text format.
+func metricsHandler(m *Metrics) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/plain; version=0.0.4", []byte(m.String()))
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	m.Register("b_total", "counter", "Bs.", func() float64 { return 3 })
+	m.Register("a", "gauge", "As.", func() float64 { return 1.5 })
+	m.Register("b_total", "counter", "More Bs.", func() float64 { return 4 })
+
+	want := `# HELP a As.
+# TYPE a gauge
+a 1.5
+# HELP b_total More Bs.
+# TYPE b_total counter
+b_total 4
+`
+	if s := m.String(); s != want {
+		t.Errorf("got\n%s\nwant\n%s", s, want)
+	}
+}
+
+func TestMetricsLabels(t *testing.T) {
+	m := NewMetrics()
+	m.Register(`c_total{league="b"}`, "counter", "Cs.", func() float64 { return 2 })
+	m.Register(`c_total{league="a"}`, "counter", "Cs.", func() float64 { return 1 })
+	m.Register("c_total_x", "gauge", "Xs.", func() float64 { return 3 })
+
+	want := `# HELP c_total Cs.
+# TYPE c_total counter
+c_total{league="a"} 1
+c_total{league="b"} 2
+# HELP c_total_x Xs.
+# TYPE c_total_x gauge
+c_total_x 3
+`
+	if s := m.String(); s != want {
+		t.Errorf("got\n%s\nwant\n%s", s, want)
+	}
+}
+
+func TestMetricsFamilyPrefix(t *testing.T) {
+	m := NewMetrics()
+	m.Register(`foo{league="a"}`, "gauge", "Foos.", func() float64 { return 2 })
+	m.Register("foo_bar", "counter", "Foo bars.", func() float64 { return 3 })
+	m.Register("foo", "gauge", "Foos.", func() float64 { return 1 })
+
+	// each family appears once, even though foo_bar sorts between foo and
+	// foo{...} by full name
+	want := `# HELP foo Foos.
+# TYPE foo gauge
+foo 1
+foo{league="a"} 2
+# HELP foo_bar Foo bars.
+# TYPE foo_bar counter
+foo_bar 3
+`
+	if s := m.String(); s != want {
+		t.Errorf("got\n%s\nwant\n%s", s, want)
+	}
+}
+
+func TestMetricsCollector(t *testing.T) {
+	m := NewMetrics()
+	calls := 0
+	m.RegisterCollector([]MetricDesc{
+		{`d{kind="x"}`, "gauge", "Ds."},
+		{`d{kind="y"}`, "gauge", "Ds."},
+		{"e", "gauge", "Es."},
+	}, func() map[string]float64 {
+		calls++
+		return map[string]float64{`d{kind="x"}`: float64(calls), `d{kind="y"}`: float64(10 * calls)}
+	})
+
+	want := `# HELP d Ds.
+# TYPE d gauge
+d{kind="x"} 1
+d{kind="y"} 10
+# HELP e Es.
+# TYPE e gauge
+e 0
+`
+	if s := m.String(); s != want {
+		t.Errorf("got\n%s\nwant\n%s", s, want)
+	}
+	// collected once per scrape
+	_ = m.String()
+	if calls != 2 {
+		t.Errorf("collector called %d times for 2 scrapes", calls)
+	}
+}
+
+func TestMetricsSlowValue(t *testing.T) {
+	m := NewMetrics()
+	release := make(chan struct{})
+	m.Register("slow", "gauge", "Blocks.", func() float64 {
+		<-release
+		return 1
+	})
+	scraped := make(chan string)
+	go func() { scraped <- m.String() }()
+
+	// a blocked value doesn't block the registry
+	done := make(chan struct{})
+	go func() {
+		m.Register("fast", "gauge", "Fast.", func() float64 { return 2 })
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Register blocked by a slow value")
+	}
+	close(release)
+	if s := <-scraped; s == "" {
+		t.Error("empty scrape")
+	}
+}
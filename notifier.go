@@ -2,36 +2,132 @@ package main
 
 import "container/list"
 
-// notifierBufSize specifies how many messages to buffer.
-// The channel is closed once the buffer
+// notifierBufSize specifies how many messages to buffer by default.
+// The channel is closed once the buffer is full.
 const notifierBufSize = 10
 
-type Notifier struct {
-	st chan notifierState
+// Notifier broadcasts events of type T to all registered channels.
+type Notifier[T any] struct {
+	st      chan notifierState[T]
+	bufSize int
+	replay  bool // deliver the last event on registration
 }
 
-type notifierState struct {
-	wait *list.List // of chan<- interface{}
+type notifierState[T any] struct {
+	wait    *list.List // of chan T, *blockingListener[T] or *resyncListener[T]
+	closed  bool
+	last    T    // last event, if replay is set
+	hasLast bool // an event was sent
 }
 
-func NewNotifier() *Notifier {
-	n := &Notifier{st: make(chan notifierState, 1)}
-	n.st <- notifierState{wait: list.New()}
+func NewNotifier[T any]() *Notifier[T] {
+	return NewNotifierWithBuffer[T](notifierBufSize)
+}
+
+// NewNotifierWithBuffer creates a Notifier whose channels buffer size
+// messages.
+func NewNotifierWithBuffer[T any](size int) *Notifier[T] {
+	n := &Notifier[T]{st: make(chan notifierState[T], 1), bufSize: size}
+	n.st <- notifierState[T]{wait: list.New()}
+	return n
+}
+
+// NewReplayNotifier creates a Notifier that keeps the last event and delivers
+// it to every channel right when it's registered, so that new listeners know
+// the current state without waiting for the next change. This suits
+// notifiers whose events describe the whole state rather than a change of a
+// part of it.
+func NewReplayNotifier[T any]() *Notifier[T] {
+	n := NewNotifier[T]()
+	n.replay = true
 	return n
 }
 
-func (n *Notifier) Register() <-chan interface{} {
-	c := make(chan interface{}, notifierBufSize)
+// replayTo returns the event to deliver to a new channel, if any.
+func (n *Notifier[T]) replayTo(st *notifierState[T]) (T, bool) {
+	return st.last, n.replay && st.hasLast && !st.closed
+}
+
+func (n *Notifier[T]) Register() <-chan T {
+	c := make(chan T, n.bufSize)
 	st := <-n.st
-	st.wait.PushBack(c)
+	if st.closed {
+		close(c)
+	} else {
+		st.wait.PushBack(c)
+	}
+	if ev, ok := n.replayTo(&st); ok {
+		select {
+		case c <- ev:
+		default:
+			// unbuffered channel, nobody can be receiving yet
+		}
+	}
 	n.st <- st
 	return c
 }
 
-func (n *Notifier) Unregister(c <-chan interface{}) {
+// RegisterBlocking registers a channel that never drops events, for consumers
+// that must see every event.
+//
+// Events are queued and delivered from a dedicated goroutine, so a slow
+// consumer doesn't stall Notify (and thereby all other listeners). The
+// tradeoff is that the queue grows without bounds while the consumer lags
+// behind: a consumer that stops reading must call Unregister.
+func (n *Notifier[T]) RegisterBlocking() <-chan T {
+	l := &blockingListener[T]{
+		in:   make(chan T),
+		quit: make(chan struct{}),
+		out:  make(chan T, n.bufSize),
+	}
+	go l.run()
+	st := <-n.st
+	if st.closed {
+		close(l.in)
+	} else {
+		st.wait.PushBack(l)
+	}
+	if ev, ok := n.replayTo(&st); ok {
+		l.in <- ev
+	}
+	n.st <- st
+	return l.out
+}
+
+// RegisterResync registers a channel that is never dropped for falling
+// behind. Instead, once its buffer is full, events are discarded and replaced
+// by a single sentinel. A consumer receiving the sentinel must fetch the full
+// state again, as it missed events before it. Delivery resumes once the
+// sentinel was received.
+func (n *Notifier[T]) RegisterResync(sentinel T) <-chan T {
+	// one slot more than the buffer size to always fit the sentinel
+	l := &resyncListener[T]{c: make(chan T, n.bufSize+1), sentinel: sentinel}
+	st := <-n.st
+	if st.closed {
+		close(l.c)
+	} else {
+		st.wait.PushBack(l)
+	}
+	if ev, ok := n.replayTo(&st); ok {
+		l.notify(ev, n.bufSize)
+	}
+	n.st <- st
+	return l.c
+}
+
+func (n *Notifier[T]) Unregister(c <-chan T) {
 	st := <-n.st
 	for e := st.wait.Front(); e != nil; e = e.Next() {
-		if e.Value == c {
+		if l, ok := e.Value.(*resyncListener[T]); ok && l.c == c {
+			st.wait.Remove(e)
+			break
+		}
+		if l, ok := e.Value.(*blockingListener[T]); ok && l.out == c {
+			st.wait.Remove(e)
+			close(l.quit)
+			break
+		}
+		if ch, ok := e.Value.(chan T); ok && ch == c {
 			st.wait.Remove(e)
 			break
 		}
@@ -39,10 +135,23 @@ func (n *Notifier) Unregister(c <-chan interface{}) {
 	n.st <- st
 }
 
-func (n *Notifier) Notify(event interface{}) {
+func (n *Notifier[T]) Notify(event T) {
 	st := <-n.st
-	for e := st.wait.Front(); e != nil; e = e.Next() {
-		c := e.Value.(chan interface{})
+	if n.replay {
+		st.last, st.hasLast = event, true
+	}
+	var next *list.Element
+	for e := st.wait.Front(); e != nil; e = next {
+		next = e.Next()
+		if l, ok := e.Value.(*blockingListener[T]); ok {
+			l.in <- event
+			continue
+		}
+		if l, ok := e.Value.(*resyncListener[T]); ok {
+			l.notify(event, n.bufSize)
+			continue
+		}
+		c := e.Value.(chan T)
 		select {
 		case c <- event:
 			// ok
@@ -54,3 +163,88 @@ func (n *Notifier) Notify(event interface{}) {
 	}
 	n.st <- st
 }
+
+// Count returns the number of registered channels.
+func (n *Notifier[T]) Count() int {
+	st := <-n.st
+	count := st.wait.Len()
+	n.st <- st
+	return count
+}
+
+// Close closes all registered channels. Channels registered afterwards are
+// closed immediately.
+func (n *Notifier[T]) Close() {
+	st := <-n.st
+	for e := st.wait.Front(); e != nil; e = e.Next() {
+		switch l := e.Value.(type) {
+		case *blockingListener[T]:
+			close(l.in)
+		case *resyncListener[T]:
+			close(l.c)
+		case chan T:
+			close(l)
+		}
+	}
+	st.wait.Init()
+	st.closed = true
+	n.st <- st
+}
+
+// blockingListener forwards events from in to out without dropping any.
+type blockingListener[T any] struct {
+	in   chan T        // closed by Close: deliver queued events, then close out
+	quit chan struct{} // closed by Unregister: drop queued events
+	out  chan T
+}
+
+func (l *blockingListener[T]) run() {
+	queue := list.New()
+	in := l.in
+	for in != nil || queue.Len() > 0 {
+		// only try to deliver if there is something queued
+		var out chan T
+		var next T
+		if queue.Len() > 0 {
+			out = l.out
+			next = queue.Front().Value.(T)
+		}
+
+		select {
+		case event, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			queue.PushBack(event)
+		case out <- next:
+			queue.Remove(queue.Front())
+		case <-l.quit:
+			return
+		}
+	}
+	close(l.out)
+}
+
+// resyncListener replaces the events that don't fit its buffer by a sentinel.
+type resyncListener[T any] struct {
+	c         chan T
+	sentinel  T
+	resyncing bool // the sentinel was sent, events are discarded until it was received
+}
+
+// notify delivers the event, or the sentinel if the buffer is full. Only
+// Notify sends on c, so checking its length is race-free.
+func (l *resyncListener[T]) notify(event T, bufSize int) {
+	switch {
+	case l.resyncing && len(l.c) > 0:
+		// the sentinel is the last queued value, so the consumer
+		// fetches this event with the full state
+	case len(l.c) < bufSize:
+		l.resyncing = false
+		l.c <- event
+	default:
+		l.resyncing = true
+		l.c <- l.sentinel
+	}
+}
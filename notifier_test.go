@@ -0,0 +1,147 @@
+package main
+
+import "testing"
+
+func TestNotifierBlocking(t *testing.T) {
+	n := NewNotifierWithBuffer[int](2)
+	lossy := n.Register()
+	blocking := n.RegisterBlocking()
+
+	for i := 0; i < 100; i++ {
+		n.Notify(i)
+	}
+
+	// the lossy listener is dropped once its buffer is full
+	count := 0
+	for range lossy {
+		count++
+	}
+	if count != 2 {
+		t.Errorf("lossy listener received %d events, want 2", count)
+	}
+
+	for i := 0; i < 100; i++ {
+		if ev := <-blocking; ev != i {
+			t.Fatalf("blocking listener received %v, want %d", ev, i)
+		}
+	}
+
+	n.Notify(100)
+	n.Close()
+	if ev := <-blocking; ev != 100 {
+		t.Errorf("blocking listener received %v, want 100", ev)
+	}
+	if ev, ok := <-blocking; ok {
+		t.Errorf("blocking listener received %v after Close", ev)
+	}
+}
+
+func TestNotifierBufferSize(t *testing.T) {
+	for _, size := range []int{1, 5, notifierBufSize, 50} {
+		n := NewNotifierWithBuffer[int](size)
+		lossy := n.Register()
+		resync := n.RegisterResync(-1)
+		for i := 0; i < 100; i++ {
+			n.Notify(i)
+		}
+
+		count := 0
+		for range lossy {
+			count++
+		}
+		if count != size {
+			t.Errorf("size %d: lossy listener received %d events before it was dropped", size, count)
+		}
+		for i := 0; i < size; i++ {
+			if ev := <-resync; ev != i {
+				t.Fatalf("size %d: resync listener received %v, want %d", size, ev, i)
+			}
+		}
+		if ev := <-resync; ev != -1 {
+			t.Errorf("size %d: resync listener received %v after its buffer, want the sentinel", size, ev)
+		}
+	}
+}
+
+func TestNotifierUnregisterBlocking(t *testing.T) {
+	n := NewNotifier[int]()
+	blocking := n.RegisterBlocking()
+	n.Notify(1)
+	n.Unregister(blocking)
+	// must neither block nor panic
+	n.Notify(2)
+	if c := n.Count(); c != 0 {
+		t.Errorf("Count() = %d after Unregister", c)
+	}
+}
+
+func TestNotifierResync(t *testing.T) {
+	n := NewNotifierWithBuffer[int](2)
+	c := n.RegisterResync(-1)
+
+	// a burst while the consumer doesn't read
+	for i := 0; i < 100; i++ {
+		n.Notify(i)
+	}
+	for _, want := range []int{0, 1, -1} {
+		if ev := <-c; ev != want {
+			t.Errorf("received %d, want %d", ev, want)
+		}
+	}
+	// delivery resumes after the sentinel
+	n.Notify(100)
+	if ev := <-c; ev != 100 {
+		t.Errorf("received %d after resync, want 100", ev)
+	}
+	if n.Count() != 1 {
+		t.Error("resync listener was dropped")
+	}
+
+	n.Unregister(c)
+	if n.Count() != 0 {
+		t.Errorf("Count() = %d after Unregister", n.Count())
+	}
+	c = n.RegisterResync(-1)
+	n.Close()
+	if _, ok := <-c; ok {
+		t.Error("channel not closed after Close")
+	}
+}
+
+func TestReplayNotifier(t *testing.T) {
+	n := NewReplayNotifier[int]()
+	before := n.Register()
+	if len(before) != 0 {
+		t.Error("replayed an event before the first Notify")
+	}
+	n.Notify(1)
+	n.Notify(2)
+	if ev := <-before; ev != 1 {
+		t.Errorf("received %d, want 1", ev)
+	}
+
+	// new listeners get the last event right away
+	lossy := n.Register()
+	blocking := n.RegisterBlocking()
+	resync := n.RegisterResync(-1)
+	for name, c := range map[string]<-chan int{"lossy": lossy, "blocking": blocking, "resync": resync} {
+		if ev := <-c; ev != 2 {
+			t.Errorf("%s listener received %d, want 2", name, ev)
+		}
+	}
+	n.Notify(3)
+	if ev := <-lossy; ev != 3 {
+		t.Errorf("received %d after replay, want 3", ev)
+	}
+
+	// the default Notifier doesn't replay
+	plain := NewNotifier[int]()
+	plain.Notify(1)
+	if c := plain.Register(); len(c) != 0 {
+		t.Error("plain Notifier replayed an event")
+	}
+	n.Close()
+	if _, ok := <-n.Register(); ok {
+		t.Error("replayed an event after Close")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// cacheFile is the file the cache is persisted to. Persistence is disabled if
+// empty.
+var cacheFile = ""
+
+// persistInterval is the interval in which the cache is written to cacheFile.
+var persistInterval = 5 * time.Minute
+
+// persistedGame is the on-disk representation of a CacheItem.
+type persistedGame struct {
+	Game          LeagueGame     `json:"game"`
+	Addrs         persistedAddrs `json:"addrs"`
+	AddrsFetched  bool           `json:"addrsFetched,omitempty"`
+	NoPublicAddrs bool           `json:"noPublicAddrs,omitempty"`
+	// Reachability is the last recorded reachability, so that the first
+	// check after a restart isn't taken for a flip.
+	Reachability ConnectStatus `json:"reachability,omitempty"`
+}
+
+// persistedAddrs are the addresses of a persistedGame. Invalid addresses, e.g.
+// of a network that is no longer supported, are skipped when decoding instead
+// of failing the whole cache file.
+type persistedAddrs []AddrStatus
+
+func (as *persistedAddrs) UnmarshalJSON(b []byte) error {
+	var raws []json.RawMessage
+	if err := json.Unmarshal(b, &raws); err != nil {
+		return err
+	}
+	*as = make(persistedAddrs, 0, len(raws))
+	for _, raw := range raws {
+		var a AddrStatus
+		if err := json.Unmarshal(raw, &a); err != nil {
+			log.WithError(err).WithField("addr", string(raw)).Warn("load: skipping invalid address")
+			continue
+		}
+		*as = append(*as, a)
+	}
+	return nil
+}
+
+// internal (run): save writes the cache to cacheFile.
+func (c *Cache) save() error {
+	games := make([]persistedGame, 0, len(c.games))
+	for _, g := range c.games {
+		games = append(games, persistedGame{Game: g.Game, Addrs: g.AddrStatuses(), AddrsFetched: g.AddrsFetched, NoPublicAddrs: g.NoPublicAddrs, Reachability: g.reachability})
+	}
+	b, err := json.Marshal(games)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first so that a crash can't leave a
+	// half-written cache behind
+	tmp := cacheFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cacheFile)
+}
+
+// load restores the cache from cacheFile. Must be called before starting run.
+// Restored addresses keep their status, but are checked again right away.
+// Games keep their reachability, so that only actual changes are recorded as
+// flips afterwards.
+func (c *Cache) load() error {
+	b, err := ioutil.ReadFile(cacheFile)
+	if err != nil {
+		return err
+	}
+	var games []persistedGame
+	if err := json.Unmarshal(b, &games); err != nil {
+		return err
+	}
+	for _, pg := range games {
+		g := CacheItem{Game: pg.Game, Addrs: make(map[string]CacheItemAddr), AddrsFetched: pg.AddrsFetched, NoPublicAddrs: pg.NoPublicAddrs, added: time.Now()}
+		for _, a := range pg.Addrs {
+			g.Addrs[cacheAddrKey(a.Addr)] = CacheItemAddr{
+				Addr:        a.Addr,
+				Status:      a.Status,
+				LastChecked: a.LastChecked,
+				Reason:      a.Reason,
+				backoff:     failureBackoffMin,
+			}
+		}
+		g.reachability = pg.Reachability
+		if g.reachability == ConnectStatusPending {
+			// written before the reachability was persisted
+			g.reachability = g.Reachability()
+		}
+		c.games[pg.Game.Key()] = g
+	}
+	return nil
+}
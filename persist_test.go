@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCachePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocrema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cacheFile = filepath.Join(dir, "cache.json")
+	defer func() { cacheFile = "" }()
+
+	addr := &NetpuncherAddr{Net: "netpuncher4", Addr: "invalid", ID: 42}
+	c := NewCache()
+	c.UpdateGame(LeagueGame{ID: 1, Title: "foo"})
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{addr})
+	c.Get()
+	c.Close()
+
+	c = NewCache()
+	defer c.Close()
+	g, ok := c.GetGame(GameKey{ID: 1})
+	if !ok {
+		t.Fatal("game wasn't restored")
+	}
+	if g.Game.Title != "foo" {
+		t.Errorf("unexpected title %q", g.Game.Title)
+	}
+	a, ok := g.Addrs[cacheAddrKey(addr)]
+	if !ok {
+		t.Fatalf("address wasn't restored: %v", g.Addrs)
+	}
+	if np, ok := a.Addr.(*NetpuncherAddr); !ok || *np != *addr {
+		t.Errorf("unexpected address %#v", a.Addr)
+	}
+}
+
+func TestCachePersistenceReachability(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocrema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cacheFile = filepath.Join(dir, "cache.json")
+	defer func() { cacheFile = "" }()
+	oldChecker := defaultChecker
+	defer func() { defaultChecker = oldChecker }()
+	failWith := func(reason string) Checker {
+		return connectChecker(func(ctx context.Context, addr net.Addr) error { return errors.New(reason) })
+	}
+
+	addr := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11113}
+	// waitChecked waits until the address was checked after since
+	waitChecked := func(c *Cache, since time.Time) CacheItem {
+		for i := 0; ; i++ {
+			g, _ := c.GetGame(GameKey{ID: 1})
+			if a := g.Addrs[cacheAddrKey(addr)]; a.LastChecked.After(since) {
+				return g
+			}
+			if i == 5000 {
+				t.Fatal("address not checked")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	defaultChecker = failWith("refused")
+	c := NewCache()
+	c.UpdateGame(LeagueGame{ID: 1})
+	c.UpdateAddrs(GameKey{ID: 1}, []net.Addr{addr})
+	if g := waitChecked(c, time.Time{}); len(g.History) != 1 {
+		t.Fatalf("got history %+v, want the first check", g.History)
+	}
+	c.Close()
+
+	restarted := time.Now()
+	defaultChecker = failWith("timeout")
+	c = NewCache()
+	defer c.Close()
+	// the check after the restart changes the reason, but not the restored
+	// reachability
+	if g := waitChecked(c, restarted); len(g.History) != 0 {
+		t.Errorf("got history %+v after restart, want no flip", g.History)
+	}
+}
+
+func TestPersistedGameSkipsInvalidAddrs(t *testing.T) {
+	var pg persistedGame
+	b := `{"game": {"id": 1}, "addrs": [
+		{"network": "ip", "addr": "1.2.3.4"},
+		{"network": "tcp", "addr": "1.2.3.4:11113", "status": "success"}
+	], "reachability": "success"}`
+	if err := json.Unmarshal([]byte(b), &pg); err != nil {
+		t.Fatal(err)
+	}
+	if len(pg.Addrs) != 1 || pg.Addrs[0].Addr.String() != "1.2.3.4:11113" || pg.Addrs[0].Status != ConnectStatusSuccess {
+		t.Errorf("got addresses %+v, want only the valid one", pg.Addrs)
+	}
+	if pg.Game.ID != 1 || pg.Reachability != ConnectStatusSuccess {
+		t.Errorf("unexpected game %+v", pg)
+	}
+	if err := json.Unmarshal([]byte(`{"addrs": {}}`), &pg); err == nil {
+		t.Error("no error for addresses that aren't a list")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// dnsCacheTTL is the time a resolved netpuncher address is reused before it
+// is looked up again.
+var dnsCacheTTL = 5 * time.Minute
+
+// dnsNegativeTTL is the time a failed lookup is remembered.
+var dnsNegativeTTL = 30 * time.Second
+
+// resolver caches the lookups of netpuncher addresses, which are usually
+// host names and would otherwise be resolved on every check.
+var resolver = newDNSCache()
+
+type dnsEntry struct {
+	addr    *net.UDPAddr
+	err     error
+	expires time.Time
+}
+
+// dnsCache is a resolver cache with a fixed TTL.
+type dnsCache struct {
+	st     chan map[string]dnsEntry
+	lookup func(network, address string) (*net.UDPAddr, error) // net.ResolveUDPAddr, replaceable in tests
+}
+
+func newDNSCache() *dnsCache {
+	d := &dnsCache{st: make(chan map[string]dnsEntry, 1), lookup: net.ResolveUDPAddr}
+	d.st <- make(map[string]dnsEntry)
+	return d
+}
+
+// ResolveUDPAddr works like net.ResolveUDPAddr, but returns cached results
+// for lookups within dnsCacheTTL, or dnsNegativeTTL for failures.
+func (d *dnsCache) ResolveUDPAddr(address string) (*net.UDPAddr, error) {
+	now := time.Now()
+	entries := <-d.st
+	e, ok := entries[address]
+	d.st <- entries
+	if ok && now.Before(e.expires) {
+		return e.addr, e.err
+	}
+
+	// don't hold the lock while resolving
+	addr, err := d.lookup("udp", address)
+	ttl := dnsCacheTTL
+	if err != nil {
+		ttl = dnsNegativeTTL
+	}
+
+	entries = <-d.st
+	// drop expired entries so that the cache doesn't grow forever
+	for k, e := range entries {
+		if !now.Before(e.expires) {
+			delete(entries, k)
+		}
+	}
+	entries[address] = dnsEntry{addr: addr, err: err, expires: now.Add(ttl)}
+	d.st <- entries
+	return addr, err
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDNSCache(t *testing.T) {
+	oldTTL, oldNegativeTTL := dnsCacheTTL, dnsNegativeTTL
+	defer func() { dnsCacheTTL, dnsNegativeTTL = oldTTL, oldNegativeTTL }()
+	dnsCacheTTL, dnsNegativeTTL = time.Minute, time.Minute
+
+	lookups := 0
+	d := newDNSCache()
+	d.lookup = func(network, address string) (*net.UDPAddr, error) {
+		lookups++
+		if address == "invalid:11115" {
+			return nil, errors.New("no such host")
+		}
+		return &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 11115}, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		if addr, err := d.ResolveUDPAddr("netpuncher.example:11115"); err != nil || addr.String() != "1.2.3.4:11115" {
+			t.Errorf("got %v, %v", addr, err)
+		}
+		if _, err := d.ResolveUDPAddr("invalid:11115"); err == nil {
+			t.Error("expected cached error")
+		}
+	}
+	if lookups != 2 {
+		t.Errorf("%d lookups, want 2", lookups)
+	}
+
+	// expired entries are looked up again
+	dnsCacheTTL, dnsNegativeTTL = 0, 0
+	d = newDNSCache()
+	d.lookup = func(network, address string) (*net.UDPAddr, error) {
+		lookups++
+		return &net.UDPAddr{}, nil
+	}
+	lookups = 0
+	d.ResolveUDPAddr("netpuncher.example:11115")
+	d.ResolveUDPAddr("netpuncher.example:11115")
+	if lookups != 2 {
+		t.Errorf("%d lookups without caching, want 2", lookups)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import "net"
+
+// SourceCache is a view of the games of a single league in a Cache. It
+// identifies games by their plain id and sets LeagueGame.Source on updates.
+type SourceCache struct {
+	*Cache
+	Source string
+}
+
+// Source returns a view of the games of the league with the given name.
+func (c *Cache) Source(name string) *SourceCache {
+	return &SourceCache{Cache: c, Source: name}
+}
+
+// Key returns the cache key of the game with the given id.
+func (s *SourceCache) Key(id int) GameKey {
+	return GameKey{Source: s.Source, ID: id}
+}
+
+// UpdateAllGames inserts and updates the given games, deleting all other games
+// of the league from the cache.
+func (s *SourceCache) UpdateAllGames(games []LeagueGame) {
+	for i := range games {
+		games[i].Source = s.Source
+	}
+	s.Cache.UpdateSourceGames(s.Source, games)
+}
+
+// UpdateGame inserts or updates a single game.
+func (s *SourceCache) UpdateGame(game LeagueGame) {
+	game.Source = s.Source
+	s.Cache.UpdateGame(game)
+}
+
+// UpdateAddrs updates a game's addresses.
+func (s *SourceCache) UpdateAddrs(id int, addrs []net.Addr) {
+	s.Cache.UpdateAddrs(s.Key(id), addrs)
+}
+
+// DeleteGame removes a game from the cache.
+func (s *SourceCache) DeleteGame(id int) {
+	s.Cache.DeleteGame(s.Key(id))
+}
+
+// GetGame retrieves a copy of a single cached game.
+func (s *SourceCache) GetGame(id int) (CacheItem, bool) {
+	return s.Cache.GetGame(s.Key(id))
+}
+
+// Get retrieves a copy of the currently-cached games of the league by id.
+func (s *SourceCache) Get() map[int]CacheItem {
+	games := make(map[int]CacheItem)
+	for k, g := range s.Cache.GetFiltered(func(g CacheItem) bool { return g.Game.Source == s.Source }) {
+		games[k.ID] = g
+	}
+	return games
+}